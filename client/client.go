@@ -2,14 +2,20 @@ package chclient
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -30,7 +36,9 @@ import (
 //Config represents a client configuration
 type Config struct {
 	Fingerprint      string
+	FingerprintFile  string
 	Auth             string
+	AuthFile         string
 	KeepAlive        time.Duration
 	MaxRetryCount    int
 	MaxRetryInterval time.Duration
@@ -38,9 +46,320 @@ type Config struct {
 	Proxy            string
 	Remotes          []string
 	Headers          http.Header
-	DialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
+	//UserAgent, when set, is the User-Agent header of the
+	//websocket upgrade request, overriding any in Headers
+	UserAgent string
+	//ExpectServerHeaders are response headers the server (or the
+	//intermediaries in front of it) must send in the websocket
+	//handshake, with the given value, or any when it's empty.
+	//Connections without them fail, and are retried.
+	ExpectServerHeaders map[string]string
+	//DialContext dials the server, and the remotes with
+	//fallback-direct while the tunnel is down
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	//LookupHost resolves the server's hostname, afresh for each
+	//connection attempt, it defaults to net.DefaultResolver.LookupHost.
+	//It's unused via a Proxy, which resolves the server itself.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+	//RotateServerAddrs dials one of the server's addresses per
+	//connection attempt, moving to the next after a failed dial,
+	//rather than each address in turn (as with the default)
+	RotateServerAddrs bool
+	//PreferTLS connects to a Server given without a scheme over
+	//wss (on port 443, unless a port is given), falling back to ws
+	//with a warning only if that fails. The outcome is kept for
+	//reconnects. Servers given with a scheme are unaffected.
+	PreferTLS bool
+	//MinTLSVersion ("1.0" to "1.3") and TLSCipherSuites (IANA
+	//names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) restrict the
+	//wss connection to the server, the handshake fails when the
+	//server doesn't support them. TLS 1.3 suites can't be chosen,
+	//so the TLSCipherSuites only apply to TLS 1.2 and below.
+	MinTLSVersion   string
+	TLSCipherSuites []string
+	//AuthMethods replaces the password from Auth with the given SSH
+	//auth methods, offered in order, the user is still taken from
+	//Auth. The chisel server only accepts password auth.
+	AuthMethods []ssh.AuthMethod
+	//RekeyBytes sets the number of bytes after which the SSH
+	//session keys are renegotiated (defaults to the crypto/ssh default)
+	RekeyBytes int64
+	//ReconnectInterval forces a reconnect once the connection has been
+	//open for the given duration, so its SSH session (and keys) are
+	//renewed. It isn't a rekey in place, crypto/ssh can only rekey by
+	//bytes, so tunneled connections in flight are dropped, while the
+	//listeners are kept. Defaults to never.
+	ReconnectInterval time.Duration
+	//DryRun makes Start resolve and log the planned tunnels,
+	//without binding any listeners or connecting to the server
+	DryRun bool
+	//DialTimeout limits the client's outbound dials for
+	//reverse remotes, unless overridden with a timeout= option
+	DialTimeout time.Duration
+	//SyncListen makes Start block until every local remote
+	//is listening, returning an error if any fail to bind
+	SyncListen bool
+	//FastRetries retries the first few failed connection attempts
+	//quickly, without backoff, to ride out races while booting (e.g.
+	//DNS or the network not being ready). They only apply before the
+	//first connection, during the FastRetryWindow after Start (when
+	//set), and don't count towards the MaxRetryCount. Defaults
+	//to 0, the normal backoff from the first failure.
+	FastRetries     int
+	FastRetryWindow time.Duration
+	//RequestHandlers handle custom SSH global requests from the
+	//server by type (see Server.SendRequest), the built-in request
+	//types take precedence and unknown types are rejected
+	RequestHandlers map[string]func(payload []byte) (ok bool, reply []byte)
+	//StartupOrder controls whether local remotes are bound
+	//before, after, or while first connecting to the server
+	StartupOrder StartupOrder
+	//RetryPolicy is a clearer alternative to MaxRetryCount, which
+	//is the number of retries after a failed connection attempt
+	//before giving up (counted since the last connection): 0 gives
+	//up on the first failure, and negative values retry forever.
+	//RetryDefault (the zero value) uses MaxRetryCount as is.
+	RetryPolicy RetryPolicy
+	//OnAuthenticated is called (in its own goroutine)
+	//each time the client authenticates with the server
+	OnAuthenticated func(AuthInfo)
+	//OnRemoteBound is called (in its own goroutine, in order) for each
+	//listener of the reverse remotes the server bound while connecting,
+	//on each connection, with the server side address, whose port
+	//may change between connections (see RequestAlternatePort)
+	OnRemoteBound func(remote settings.Remote, serverAddr string)
+	//LogBufferSize keeps the given number of recent
+	//log lines in memory, see Client.RecentLogs
+	LogBufferSize int
+	//EventLogFile appends an Event, as a line of JSON, for each
+	//connection state change (an audit trail, separate from the
+	//log), the file is reopened when rotated
+	EventLogFile string
+	//KeepAliveTimeout is how long to wait for a keepalive
+	//reply (defaults to the KeepAlive interval)
+	KeepAliveTimeout time.Duration
+	//KeepAliveMaxFailures is the number of consecutive failed
+	//keepalives before reconnecting (defaults to 1)
+	KeepAliveMaxFailures int
+	//WebSocketPing sends WebSocket ping frames every interval,
+	//independently of the SSH KeepAlive, reconnecting when a pong
+	//isn't received within the WebSocketPingTimeout (defaults to
+	//the interval). Pongs come from the server's WebSocket layer,
+	//so unlike keepalives, they don't detect a stuck SSH server.
+	WebSocketPing        time.Duration
+	WebSocketPingTimeout time.Duration
+	//ConnFactory, when set, replaces the WebSocket transport, the
+	//SSH handshake is performed directly over the returned conn
+	ConnFactory func(ctx context.Context) (net.Conn, error)
+	//AllowServerRemotes lets the server add and remove this
+	//client's remotes while connected. Server pushed reverse
+	//remotes allow the server to dial from the client's network.
+	AllowServerRemotes bool
+	//RequestAlternatePort asks the server to bind a reverse remote
+	//whose port is in use (e.g. by another client) to a free port,
+	//rather than failing. The bound port is listed by Tunnels, and
+	//may change on each reconnect. Older servers ignore it.
+	RequestAlternatePort bool
+	//ClientID identifies the client to the server (see the server's
+	//ClientID), such as an instance ID, it defaults to the hostname,
+	//unless NoClientID is set
+	ClientID   string
+	NoClientID bool
+	//ReverseBindRetries is the number of times to reconnect, with a
+	//separate backoff, when the server fails to bind a reverse remote
+	//(e.g. its port is briefly occupied). These don't count towards
+	//MaxRetryCount, further bind failures are retried like other
+	//connection errors. Defaults to none.
+	ReverseBindRetries int
+	//AllowReplaceStdio lets a later stdio remote replace an earlier
+	//one, with a warning, rather than NewClient returning
+	//ErrMultipleStdio
+	AllowReplaceStdio bool
+	//MaxRemotes and MaxReverseRemotes limit the number of remotes,
+	//including those added at runtime (by AddRemote, or the server
+	//with AllowServerRemotes), guarding against a config requesting
+	//thousands of tunnels. Defaults to 0, unlimited.
+	MaxRemotes        int
+	MaxReverseRemotes int
+	//MaxMessageSize limits the size of WebSocket messages read from
+	//the server, larger messages close the connection. Channel data
+	//is sent in SSH packets of up to 32KB, so with their framing, the
+	//limit must be at least 36KB. Defaults to none.
+	MaxMessageSize int64
+	//ReconnectGrace keeps idle local connections open for up to this
+	//duration when the server connection is lost, bridging them to
+	//the next connection instead of closing them. The target sees a
+	//new connection and a request in flight is resent, so this only
+	//suits idempotent request/response protocols (e.g. HTTP keep-alive).
+	ReconnectGrace time.Duration
+	//ReconnectWait is how long connections accepted by local listeners
+	//wait for the server while reconnecting, the listeners stay up
+	//throughout, so clients are queued rather than refused. Connections
+	//still waiting afterwards are closed. Defaults to 35s.
+	ReconnectWait time.Duration
+	//IdleDisconnect closes the server connection once it has had no
+	//open tunnel connections for the given duration, the listeners
+	//stay up, and the next connection they accept reconnects (waiting
+	//up to the ReconnectWait). This trades that connection's latency
+	//for keeping idle clients off the server. Local udp remotes,
+	//whose packets share a long-lived connection, aren't supported.
+	IdleDisconnect time.Duration
+	//MaxBandwidth caps the total bytes per second of tcp traffic
+	//across all remotes, shared among the busy remotes
+	//according to their weight option. Defaults to no limit.
+	MaxBandwidth int64
+	//MaxConnRate limits the new connections per second accepted
+	//across all local tcp listeners, excess connections are delayed
+	//for up to a second, then closed. Defaults to no limit.
+	MaxConnRate float64
+	//SlowDialThreshold logs the dials of reverse remotes which
+	//take longer, StallThreshold logs writes which block for longer
+	//(a peer which stopped reading, or a congested tunnel)
+	SlowDialThreshold time.Duration
+	StallThreshold    time.Duration
+	//DialFilter is called before each dial of a reverse remote
+	//(including socks), it returns the address to dial instead,
+	//or an error to refuse the connection (e.g. a blocklist)
+	DialFilter func(ctx context.Context, remote settings.Remote, network, addr string) (string, error)
+	//ConnMiddleware wraps or inspects each connection accepted by a
+	//local tcp remote, and DialMiddleware each connection dialed for
+	//a reverse remote, the returned conn replaces the original in
+	//the copy path, returning nil drops the connection
+	ConnMiddleware func(remote settings.Remote, c net.Conn) net.Conn
+	DialMiddleware func(remote settings.Remote, c net.Conn) net.Conn
+	//CopyBufferSize is the buffer size of each direction of a tcp
+	//connection, larger buffers may improve throughput on links with
+	//a high bandwidth-delay product, up to the SSH channel's fixed
+	//2MB window per round trip (see Caveats). Defaults to 32KB.
+	CopyBufferSize int
+	//StatsLabels keys the Stats of each remote, by spec (the
+	//default), by the remote's name option, or not at all, which
+	//bounds them when remotes are added and removed at runtime
+	StatsLabels tunnel.StatsLabels
+	//ProfileLabels sets a pprof "remote" label on the goroutines
+	//copying each tcp connection, see runtime/pprof
+	ProfileLabels bool
+	//NoDelay sets TCP_NODELAY on the client's tcp connections, unless
+	//set by a remote's nodelay option. Go enables it by default (nil),
+	//for lower latency, while disabling it sends fewer packets.
+	NoDelay *bool
+	//KnownHostsFile pins the server fingerprint on first use, when
+	//no Fingerprint is set, storing it in the given file
+	KnownHostsFile string
+	//PinStore replaces the KnownHostsFile, for embedders which
+	//persist pins elsewhere (e.g. a database or keychain)
+	PinStore PinStore
+	//VerifyTimeout limits how long verifying the server's
+	//fingerprint may take (e.g. with a slow PinStore), the
+	//connection is retried once it elapses. Defaults to none.
+	VerifyTimeout time.Duration
+	//HostCertAuthority is the public key of an SSH CA, in
+	//authorized_keys format. The server must then present a host
+	//certificate signed by it, currently valid, for the server's
+	//hostname, instead of its key being pinned. Fingerprint is
+	//still checked, against the certified key, when set.
+	HostCertAuthority     string
+	HostCertAuthorityFile string
 }
 
+//AuthInfo describes a successful authentication with the server
+type AuthInfo struct {
+	Server      string
+	RemoteAddr  string
+	Fingerprint string
+	User        string
+	SessionID   string
+	Time        time.Time
+}
+
+//EffectiveConfig is the client's configuration
+//once defaults are applied and remotes are parsed
+type EffectiveConfig struct {
+	//Server is the normalized websocket URL
+	Server string
+	//Proxy is the outbound proxy URL, if any
+	Proxy string
+	//Remotes are the encoded remotes (including
+	//any added at runtime), in their order
+	Remotes          []string
+	Headers          http.Header
+	KeepAlive        time.Duration
+	MaxRetryCount    int
+	MaxRetryInterval time.Duration
+	DialTimeout      time.Duration
+	//MaxRemotes and MaxReverseRemotes
+	//are the limits, 0 is unlimited
+	MaxRemotes        int
+	MaxReverseRemotes int
+}
+
+//StartupOrder of binding local remotes and connecting
+type StartupOrder int
+
+const (
+	//StartConcurrently binds local remotes
+	//while connecting (the default)
+	StartConcurrently StartupOrder = iota
+	//ListenFirst binds local remotes before connecting, Start
+	//blocks until they're listening, as with SyncListen
+	ListenFirst
+	//ConnectFirst binds local remotes once first connected, so no
+	//ports are exposed while the server is unreachable
+	ConnectFirst
+)
+
+//RetryPolicy controls reconnecting after connection failures
+type RetryPolicy int
+
+const (
+	//RetryDefault follows MaxRetryCount
+	RetryDefault RetryPolicy = iota
+	//RetryNever gives up on the first failure
+	//(a MaxRetryCount of 0)
+	RetryNever
+	//RetryFixedCount gives up after MaxRetryCount
+	//retries, which must be at least 1
+	RetryFixedCount
+	//RetryForever never gives up, the interval is still
+	//capped by MaxRetryInterval (a MaxRetryCount of -1)
+	RetryForever
+)
+
+//applyRetryPolicy translates the RetryPolicy into MaxRetryCount
+func (c *Config) applyRetryPolicy() error {
+	switch c.RetryPolicy {
+	case RetryDefault:
+	case RetryNever:
+		c.MaxRetryCount = 0
+	case RetryFixedCount:
+		if c.MaxRetryCount < 1 {
+			return errors.New("RetryFixedCount requires a MaxRetryCount of at least 1")
+		}
+	case RetryForever:
+		c.MaxRetryCount = -1
+	default:
+		return fmt.Errorf("Unknown RetryPolicy %d", c.RetryPolicy)
+	}
+	return nil
+}
+
+const (
+	minRekeyBytes        = 1 << 20
+	minReconnectInterval = time.Minute
+	//an SSH packet of channel data, and its framing
+	minMessageSize = 36 << 10
+	//fastRetryInterval is the delay of FastRetries
+	fastRetryInterval = 50 * time.Millisecond
+	//dnsRetries of DNSErrors are made, from dnsRetryInterval
+	//and doubling, before falling back to the normal backoff
+	dnsRetries       = 4
+	dnsRetryInterval = 100 * time.Millisecond
+	//reachedRetryInterval caps the delay after attempts which
+	//reached the server (see ConnectStage), the network path is
+	//fine, so the server's likely restarting or briefly rejecting
+	reachedRetryInterval = 30 * time.Second
+)
+
 //Client represents a client instance
 type Client struct {
 	*cio.Logger
@@ -48,19 +367,75 @@ type Client struct {
 	computed  settings.Config
 	sshConfig *ssh.ClientConfig
 	proxyURL  *url.URL
+	tlsConfig *tls.Config
+	//server is the websocket URL, while PreferTLS is
+	//undecided, it's the wss URL and fallback is the ws one
+	serverMut sync.Mutex
 	server    string
+	fallback  string
+	//redirect is the server the client was redirected to
+	redirect string
+	//addrIndex is the next of the RotateServerAddrs
+	addrIndex int
 	connCount cnet.ConnCount
 	stop      func()
 	eg        *errgroup.Group
 	tunnel    *tunnel.Tunnel
+	//runtime remote state
+	remotesMut sync.Mutex
+	remotes    []*remote
+	runCtx     context.Context
+	//fingerprint of the current server, guarded by serverMut
+	fingerprint string
+	logs        *cio.Ring
+	events      *eventLog
+	recentErrs  recentErrors
+	hasSchedule bool
+	health      clientHealth
+	pins        PinStore
+	hostCA      ssh.PublicKey
+	//closed once first connected
+	connected     chan struct{}
+	connectedOnce sync.Once
 }
 
 //NewClient creates a new client instance
 func NewClient(c *Config) (*Client, error) {
-	//apply default scheme
-	if !strings.HasPrefix(c.Server, "http") {
+	//optionally load secrets from files
+	if err := readSecretFile(&c.Auth, c.AuthFile, "Auth"); err != nil {
+		return nil, err
+	}
+	if err := readSecretFile(&c.Fingerprint, c.FingerprintFile, "Fingerprint"); err != nil {
+		return nil, err
+	}
+	if err := readSecretFile(&c.HostCertAuthority, c.HostCertAuthorityFile, "HostCertAuthority"); err != nil {
+		return nil, err
+	}
+	//apply default scheme, http(s) and ws(s) are accepted
+	bare := !strings.Contains(c.Server, "://")
+	if bare {
 		c.Server = "http://" + c.Server
 	}
+	//prevent rekey storms
+	if c.RekeyBytes < 0 || (c.RekeyBytes > 0 && c.RekeyBytes < minRekeyBytes) {
+		return nil, fmt.Errorf("RekeyBytes must be at least %d", minRekeyBytes)
+	}
+	if c.ReconnectInterval < 0 || (c.ReconnectInterval > 0 && c.ReconnectInterval < minReconnectInterval) {
+		return nil, fmt.Errorf("ReconnectInterval must be at least %s", minReconnectInterval)
+	}
+	if c.MaxMessageSize < 0 || (c.MaxMessageSize > 0 && c.MaxMessageSize < minMessageSize) {
+		return nil, fmt.Errorf("MaxMessageSize must be at least %d", minMessageSize)
+	}
+	if c.SyncListen && c.StartupOrder == ConnectFirst {
+		return nil, errors.New("SyncListen can't be used with ConnectFirst")
+	}
+	if err := c.applyRetryPolicy(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := c.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
 	if c.MaxRetryInterval < time.Second {
 		c.MaxRetryInterval = 5 * time.Minute
 	}
@@ -69,15 +444,26 @@ func NewClient(c *Config) (*Client, error) {
 		return nil, err
 	}
 	//apply default port
-	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
+	defaultPort := !regexp.MustCompile(`:\d+$`).MatchString(u.Host)
+	if defaultPort {
 		if u.Scheme == "https" || u.Scheme == "wss" {
 			u.Host = u.Host + ":443"
 		} else {
 			u.Host = u.Host + ":80"
 		}
 	}
-	//swap to websockets scheme
+	//swap to websockets scheme, the path and query are kept
+	//for servers behind path based routing
 	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	server, fallback := u.String(), ""
+	if bare && c.PreferTLS {
+		fallback = server
+		if defaultPort {
+			u.Host = u.Hostname() + ":443"
+		}
+		u.Scheme = "wss"
+		server = u.String()
+	}
 	hasReverse := false
 	hasSocks := false
 	hasStdio := false
@@ -85,31 +471,95 @@ func NewClient(c *Config) (*Client, error) {
 		Logger: cio.NewLogger("client"),
 		config: c,
 		computed: settings.Config{
-			Version: chshare.BuildVersion,
+			Version:        chshare.BuildVersion,
+			RemoteIDs:      true,
+			AlternatePorts: c.RequestAlternatePort,
 		},
-		server: u.String(),
+		tlsConfig: tlsConfig,
+		server:    server,
+		fallback:  fallback,
+		connected: make(chan struct{}),
+	}
+	//set default log level
+	client.Logger.Info = true
+	if c.LogBufferSize > 0 {
+		client.logs = cio.NewRing(c.LogBufferSize)
+		client.Logger.SetRing(client.logs)
+	}
+	if !c.NoClientID {
+		client.computed.ClientID = c.ClientID
+		if client.computed.ClientID == "" {
+			client.computed.ClientID, _ = os.Hostname()
+		}
+	}
+	if c.EventLogFile != "" {
+		client.events, err = newEventLog(client.Logger, c.EventLogFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open EventLogFile: %s", err)
+		}
 	}
 	for _, s := range c.Remotes {
 		r, err := settings.DecodeRemote(s)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to decode remote '%s': %s", s, err)
 		}
+		duplicate, err := client.checkCollisions(r)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate {
+			continue
+		}
 		if r.Socks {
 			hasSocks = true
 		}
 		if r.Reverse {
 			hasReverse = true
+			//the client originates tls for reverse remotes
+			if _, err := r.DialTLSConfig(); err != nil {
+				return nil, err
+			}
+		}
+		if r.Schedule != "" {
+			if r.Reverse || r.Stdio {
+				return nil, fmt.Errorf("Remote '%s': only local tcp/udp remotes can be scheduled", s)
+			}
+			client.hasSchedule = true
 		}
 		if r.Stdio {
+			if hasStdio && !c.AllowReplaceStdio {
+				return nil, ErrMultipleStdio
+			}
 			if hasStdio {
-				return nil, errors.New("Only one stdio is allowed")
+				client.replaceStdio(r)
 			}
 			hasStdio = true
 		}
 		client.computed.Remotes = append(client.computed.Remotes, r)
+		client.remotes = append(client.remotes, &remote{Remote: r})
+	}
+	if err := client.computed.Remotes.CheckLimits(c.MaxRemotes, c.MaxReverseRemotes); err != nil {
+		return nil, err
+	}
+	if c.IdleDisconnect > 0 {
+		for _, r := range client.computed.Remotes {
+			if !r.Reverse && r.HasProto("udp") {
+				return nil, fmt.Errorf("Remote '%s': IdleDisconnect doesn't support local udp remotes", r)
+			}
+		}
+	}
+	if a := c.HostCertAuthority; a != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid HostCertAuthority (%s)", err)
+		}
+		client.hostCA = key
+	}
+	//trust on first use
+	client.pins = c.PinStore
+	if client.pins == nil && c.KnownHostsFile != "" {
+		client.pins = NewKnownHostsFile(c.KnownHostsFile)
 	}
-	//set default log level
-	client.Logger.Info = true
 	//outbound proxy
 	if p := c.Proxy; p != "" {
 		client.proxyURL, err = url.Parse(p)
@@ -119,23 +569,106 @@ func NewClient(c *Config) (*Client, error) {
 	}
 	//ssh auth and config
 	user, pass := settings.ParseAuth(c.Auth)
+	auth := []ssh.AuthMethod{ssh.Password(pass)}
+	if len(c.AuthMethods) > 0 {
+		auth = c.AuthMethods
+	}
 	client.sshConfig = &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
-		ClientVersion:   "SSH-" + chshare.ProtocolVersion + "-client",
-		HostKeyCallback: client.verifyServer,
-		Timeout:         30 * time.Second,
+		User:          user,
+		Auth:          auth,
+		ClientVersion: "SSH-" + chshare.ProtocolVersion + "-client",
+		Timeout:       30 * time.Second,
+	}
+	client.sshConfig.RekeyThreshold = uint64(c.RekeyBytes)
+	if client.hostCA != nil {
+		//have the server present its certificate
+		client.sshConfig.HostKeyAlgorithms = hostCertAlgos
 	}
 	//prepare client tunnel
 	client.tunnel = tunnel.New(tunnel.Config{
-		Logger:   client.Logger,
-		Inbound:  true, //client always accepts inbound
-		Outbound: hasReverse,
-		Socks:    hasReverse && hasSocks,
+		Logger:          client.Logger,
+		Inbound:         true, //client always accepts inbound
+		Outbound:        hasReverse || c.AllowServerRemotes,
+		Socks:           hasReverse && hasSocks,
+		DialTimeout:     c.DialTimeout,
+		OutboundRemotes: client.computed.Remotes.Reversed(true),
+		RequestHandlers: client.requestHandlers(),
+		//dead server detection
+		KeepAlive:            c.KeepAlive,
+		KeepAliveTimeout:     c.KeepAliveTimeout,
+		KeepAliveMaxFailures: c.KeepAliveMaxFailures,
+		ReconnectGrace:       c.ReconnectGrace,
+		ConnectWait:          c.ReconnectWait,
+		MaxBandwidth:         c.MaxBandwidth,
+		MaxConnRate:          c.MaxConnRate,
+		SlowDialThreshold:    c.SlowDialThreshold,
+		StallThreshold:       c.StallThreshold,
+		CopyBufferSize:       c.CopyBufferSize,
+		StatsLabels:          c.StatsLabels,
+		ProfileLabels:        c.ProfileLabels,
+		DialFilter:           c.DialFilter,
+		NoDelay:              c.NoDelay,
+		ConnMiddleware:       c.ConnMiddleware,
+		DialMiddleware:       c.DialMiddleware,
+		DirectDial:           c.DialContext,
 	})
 	return client, nil
 }
 
+//ErrMultipleStdio is returned by NewClient when more than
+//one stdio remote is given, without AllowReplaceStdio
+var ErrMultipleStdio = errors.New("Only one stdio is allowed")
+
+//replaceStdio drops the stdio remote computed so far, in favour of r
+func (c *Client) replaceStdio(r *settings.Remote) {
+	for i, prev := range c.computed.Remotes {
+		if prev.Stdio {
+			c.Infof("Warning: stdio remote '%s' replaces '%s'", r, prev)
+			c.computed.Remotes = append(c.computed.Remotes[:i:i], c.computed.Remotes[i+1:]...)
+			c.remotes = append(c.remotes[:i:i], c.remotes[i+1:]...)
+			return
+		}
+	}
+}
+
+//checkCollisions compares r against the remotes computed so far,
+//exact duplicates are dropped, while competing listeners are an error
+func (c *Client) checkCollisions(r *settings.Remote) (duplicate bool, err error) {
+	for _, prev := range c.computed.Remotes {
+		if prev.Encode() == r.Encode() {
+			c.Infof("Warning: ignoring duplicate remote '%s'", r)
+			return true, nil
+		}
+		if prev.Collides(*r) {
+			return false, fmt.Errorf("Remote '%s' conflicts with '%s' (both listen on port %s/%s)",
+				r, prev, r.LocalPort, r.LocalProto)
+		}
+		if prev.SharesPort(*r) {
+			c.Infof("Warning: remotes '%s' and '%s' both listen on port %s/%s, "+
+				"these will collide if the client and server share a host",
+				prev, r, r.LocalPort, r.LocalProto)
+		}
+	}
+	return false, nil
+}
+
+//readSecretFile loads the trimmed contents of path into
+//dst, it is an error to set both the field and its file
+func readSecretFile(dst *string, path, field string) error {
+	if path == "" {
+		return nil
+	}
+	if *dst != "" {
+		return fmt.Errorf("%s and %sFile cannot both be set", field, field)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %sFile: %s", field, err)
+	}
+	*dst = strings.TrimSpace(string(b))
+	return nil
+}
+
 //Run starts client and blocks while connected
 func (c *Client) Run() error {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -146,17 +679,98 @@ func (c *Client) Run() error {
 	return c.Wait()
 }
 
-func (c *Client) verifyServer(hostname string, remote net.Addr, key ssh.PublicKey) error {
+func (c *Client) verifyServer(ctx context.Context, key ssh.PublicKey) error {
+	certified := false
+	if c.hostCA != nil {
+		if err := c.verifyHostCert(key); err != nil {
+			return err
+		}
+		certified = true
+	}
+	//fingerprints are of the key, not its certificate
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
 	expect := c.config.Fingerprint
 	got := ccrypto.FingerprintKey(key)
 	if expect != "" && !strings.HasPrefix(got, expect) {
 		return fmt.Errorf("Invalid fingerprint (%s)", got)
 	}
+	if expect == "" && c.pins != nil && !certified {
+		if err := c.verifyPinContext(ctx, got); err != nil {
+			return err
+		}
+	}
 	//overwrite with complete fingerprint
 	c.Infof("Fingerprint %s", got)
+	c.serverMut.Lock()
+	c.fingerprint = got
+	c.serverMut.Unlock()
+	return nil
+}
+
+//verifyPinContext is verifyPin, giving up once ctx is done or the
+//VerifyTimeout elapses. An abandoned PinStore call still completes
+//in the background, though its result is ignored.
+func (c *Client) verifyPinContext(ctx context.Context, got string) error {
+	if d := c.config.VerifyTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.verifyPin(got)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Fingerprint verification cancelled (%s)", ctx.Err())
+	}
+}
+
+//verifyPin trusts the first fingerprint seen for the server
+func (c *Client) verifyPin(got string) error {
+	host := c.serverHost()
+	if pinned, ok := c.pins.Load(host); ok {
+		if pinned != got {
+			return fmt.Errorf("Fingerprint (%s) does not match the one pinned for %s (%s)", got, host, pinned)
+		}
+		return nil
+	}
+	if err := c.pins.Store(host, got); err != nil {
+		return fmt.Errorf("Failed to pin fingerprint: %s", err)
+	}
+	c.Infof("Pinned fingerprint for %s", host)
 	return nil
 }
 
+//serverHost is the host:port of the server
+func (c *Client) serverHost() string {
+	server := c.serverURL()
+	if u, err := url.Parse(server); err == nil {
+		return u.Host
+	}
+	return server
+}
+
+func (c *Client) serverURL() string {
+	c.serverMut.Lock()
+	defer c.serverMut.Unlock()
+	if c.redirect != "" {
+		return c.redirect
+	}
+	return c.server
+}
+
+//serverFingerprint is the fingerprint of the current server
+func (c *Client) serverFingerprint() string {
+	c.serverMut.Lock()
+	defer c.serverMut.Unlock()
+	return c.fingerprint
+}
+
 //Start client and does not block
 func (c *Client) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
@@ -167,30 +781,206 @@ func (c *Client) Start(ctx context.Context) error {
 	if c.proxyURL != nil {
 		via = " via " + c.proxyURL.String()
 	}
-	c.Infof("Connecting to %s%s\n", c.server, via)
+	if c.events != nil {
+		//Wait returns once the events are written
+		eg.Go(func() error {
+			c.events.run()
+			return nil
+		})
+	}
+	if c.config.DryRun {
+		c.events.close()
+		return c.dryRun(via)
+	}
+	//listen sockets
+	switch {
+	case c.config.SyncListen || c.config.StartupOrder == ListenFirst:
+		if err := c.bindRemotesSync(ctx); err != nil {
+			cancel()
+			c.events.close()
+			return err
+		}
+	case c.config.StartupOrder == ConnectFirst:
+		eg.Go(func() error {
+			select {
+			case <-c.connected:
+				return c.bindRemotes(ctx)
+			case <-ctx.Done():
+				return nil
+			}
+		})
+	default:
+		eg.Go(func() error {
+			return c.bindRemotes(ctx)
+		})
+	}
+	if c.hasSchedule {
+		eg.Go(func() error {
+			return c.scheduleLoop(ctx)
+		})
+	}
+	c.Infof("Connecting to %s%s\n", c.serverURL(), via)
 	//connect chisel server
 	eg.Go(func() error {
 		return c.connectionLoop(ctx)
 	})
-	//listen sockets
-	eg.Go(func() error {
-		clientInbound := c.computed.Remotes.Reversed(false)
-		return c.tunnel.BindRemotes(ctx, clientInbound)
-	})
 	return nil
 }
 
+//bindRemotesSync binds all local remotes, blocking
+//until they're listening or the context is cancelled
+func (c *Client) bindRemotesSync(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.bindRemotes(ctx)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//dryRun logs what Start would do, resolving each
+//address the client itself would bind or dial
+func (c *Client) dryRun(via string) error {
+	c.Infof("Dry run: would connect to %s%s", c.serverURL(), via)
+	for _, r := range c.computed.Remotes {
+		switch {
+		case r.Stdio:
+			c.Infof("Dry run: would pipe stdio to %s via the server", r.Remote())
+		case r.Reverse:
+			target := r.Remote()
+			if !r.Socks {
+				addrs := []string{}
+				for _, t := range r.Targets() {
+					addr, err := resolveAddr(r.RemoteProto, t.Addr)
+					if err != nil {
+						return fmt.Errorf("Remote '%s': %s", r, err)
+					}
+					addrs = append(addrs, addr)
+				}
+				target = strings.Join(addrs, ",")
+			}
+			c.Infof("Dry run: server would listen on %s/%s and forward to %s via the client",
+				r.Local(), r.LocalProto, target)
+		default:
+			addr, err := resolveAddr(r.LocalProto, r.Local())
+			if err != nil {
+				return fmt.Errorf("Remote '%s': %s", r, err)
+			}
+			c.Infof("Dry run: would listen on %s/%s and forward to %s via the server",
+				addr, r.LocalProto, r.Remote())
+		}
+	}
+	return nil
+}
+
+func resolveAddr(proto, addr string) (string, error) {
+	if proto == "udp" {
+		a, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return "", err
+		}
+		return a.String(), nil
+	}
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
 func (c *Client) connectionLoop(ctx context.Context) error {
 	//connection loop!
 	b := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	bindBackoff := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	proxyBackoff := &backoff.Backoff{Min: fastRetryInterval, Max: proxyRetryInterval}
+	dnsBackoff := &backoff.Backoff{Min: dnsRetryInterval, Max: c.config.MaxRetryInterval}
+	reachedBackoff := &backoff.Backoff{Max: reachedRetryInterval}
+	if c.config.MaxRetryInterval < reachedRetryInterval {
+		reachedBackoff.Max = c.config.MaxRetryInterval
+	}
+	attempts := func() int {
+		return int(b.Attempt() + proxyBackoff.Attempt() + reachedBackoff.Attempt())
+	}
+	start := time.Now()
+	everConnected, fast, redirects := false, 0, 0
+	defer c.events.close()
+	defer c.health.stop()
 	for {
+		c.event(Event{Event: EventConnecting, Attempt: attempts()})
 		connected, retry, err := c.connectionOnce(ctx)
+		stage := c.LastStage()
+		if connected {
+			c.event(Event{Event: EventDisconnected, Error: errString(err)})
+		} else if err != nil && ctx.Err() == nil {
+			c.event(Event{Event: EventConnectFailed, Error: err.Error(), Attempt: attempts(), Stage: stage})
+		}
 		//reset backoff after successful connections
 		if connected {
 			b.Reset()
+			bindBackoff.Reset()
+			proxyBackoff.Reset()
+			dnsBackoff.Reset()
+			reachedBackoff.Reset()
+			everConnected = true
+			redirects = 0
+		}
+		//idle, reconnect once a connection is waiting
+		if err == errIdle {
+			c.health.setIdle(true)
+			select {
+			case <-c.tunnel.Demand():
+				c.health.setIdle(false)
+				c.Infof("Reconnecting on demand")
+				continue
+			case <-ctx.Done():
+				c.health.setIdle(false)
+				c.Infof("Cancelled")
+				c.event(Event{Event: EventStopped})
+				return nil
+			}
+		}
+		//redirected to another server, connect to it now
+		if r, ok := err.(*redirectError); ok {
+			if redirects++; redirects <= maxRedirects {
+				if err = c.follow(r); err == nil {
+					continue
+				}
+			} else {
+				err = fmt.Errorf("too many redirects (%s)", r)
+				redirects = 0
+			}
+			c.unfollow()
+		} else if !connected && err != nil {
+			//the redirected server is unreachable
+			c.unfollow()
+		}
+		//server failed to bind a reverse remote, retry?
+		if _, ok := err.(*reverseBindError); ok {
+			if attempt := int(bindBackoff.Attempt()); attempt < c.config.ReverseBindRetries {
+				d := bindBackoff.Duration()
+				c.Infof("%s, retrying in %s (Attempt: %d/%d)", err, d, attempt+1, c.config.ReverseBindRetries)
+				c.event(Event{Event: EventRetrying, Attempt: attempt + 1})
+				select {
+				case <-cos.AfterSignal(d):
+					continue
+				case <-ctx.Done():
+					c.Infof("Cancelled")
+					c.event(Event{Event: EventStopped})
+					return nil
+				}
+			}
+			//then retried like other connection errors
+		}
+		if !connected && err != nil && ctx.Err() == nil {
+			c.health.fail()
 		}
 		//connection error
-		attempt := int(b.Attempt())
+		_, proxyErr := err.(*ProxyError)
+		attempt := attempts()
 		maxAttempt := c.config.MaxRetryCount
 		if err != nil {
 			//show error and attempt counts
@@ -205,16 +995,65 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 			c.Debugf(msg)
 		}
 		//give up?
-		if !retry || (maxAttempt >= 0 && attempt >= maxAttempt) {
+		if !retry {
+			c.event(Event{Event: EventStopped, Error: errString(err), Attempt: attempt})
 			break
 		}
-		d := b.Duration()
-		c.Infof("Retrying in %s...", d)
+		//boot time races, retry fast? these
+		//don't count towards the MaxRetryCount
+		window := c.config.FastRetryWindow
+		if !everConnected && fast < c.config.FastRetries && (window <= 0 || time.Since(start) < window) {
+			fast++
+			c.Infof("Retrying in %s (fast retry %d/%d)...", fastRetryInterval, fast, c.config.FastRetries)
+			c.event(Event{Event: EventRetrying, Attempt: attempt})
+			select {
+			case <-cos.AfterSignal(fastRetryInterval):
+				continue //retry now
+			case <-ctx.Done():
+				c.Infof("Cancelled")
+				c.event(Event{Event: EventStopped})
+				return nil
+			}
+		}
+		if maxAttempt >= 0 && attempt >= maxAttempt {
+			c.event(Event{Event: EventStopped, Error: errString(err), Attempt: attempt})
+			break
+		}
+		//resolver hiccups, retry sooner?
+		if _, ok := err.(*DNSError); ok && int(dnsBackoff.Attempt()) < dnsRetries {
+			d := dnsBackoff.Duration()
+			c.Infof("%s, retrying in %s (dns retry %d/%d)...", err, d, int(dnsBackoff.Attempt()), dnsRetries)
+			c.event(Event{Event: EventRetrying, Attempt: attempt})
+			select {
+			case <-cos.AfterSignal(d):
+				continue //retry now
+			case <-ctx.Done():
+				c.Infof("Cancelled")
+				c.event(Event{Event: EventStopped})
+				return nil
+			}
+		}
+		var d time.Duration
+		if proxyErr {
+			//likely still starting up
+			d = proxyBackoff.Duration()
+			c.Infof("Outbound proxy unreachable, retrying in %s...", d)
+		} else if !connected && stage.reachedServer() {
+			//reachable but rejecting, backoff separately
+			//from the unreachable server's ramp
+			d = reachedBackoff.Duration()
+			c.Infof("Server reachable (reached %s), retrying in %s...", stage, d)
+		} else {
+			d = b.Duration()
+			c.Infof("Retrying in %s...", d)
+		}
+		c.event(Event{Event: EventRetrying, Attempt: attempt + 1})
 		select {
 		case <-cos.AfterSignal(d):
 			continue //retry now
 		case <-ctx.Done():
 			c.Infof("Cancelled")
+			c.event(Event{Event: EventStopped})
 			return nil
 		}
 	}
@@ -222,6 +1061,28 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 	return nil
 }
 
+//event adds the server to ev and appends it to the EventLogFile
+func (c *Client) event(ev Event) {
+	if ev.Error != "" {
+		e := ev
+		e.Time = time.Now()
+		e.Server = c.serverURL()
+		c.recentErrs.add(e)
+	}
+	if c.events == nil {
+		return
+	}
+	ev.Server = c.serverURL()
+	c.events.emit(ev)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 //connectionOnce connects to the chisel server and blocks
 func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err error) {
 	//already closed?
@@ -233,25 +1094,35 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	//prepare dialer
-	d := websocket.Dialer{
-		HandshakeTimeout: 45 * time.Second,
-		Subprotocols:     []string{chshare.ProtocolVersion},
-	}
-	//optional proxy
-	if p := c.proxyURL; p != nil {
-		if err := c.setProxy(p, &d); err != nil {
-			return false, false, err
+	c.health.reach(StageNone)
+	//transport
+	var conn net.Conn
+	if f := c.config.ConnFactory; f != nil {
+		conn, err = f(ctx)
+		if err != nil {
+			return false, true, dnsError(err)
 		}
+	} else if conn, retry, err = c.dialWebSocket(ctx); err != nil {
+		return false, retry, err
 	}
-	wsConn, _, err := d.DialContext(ctx, c.server, c.config.Headers)
-	if err != nil {
-		return false, true, err
-	}
-	conn := cnet.NewWebSocketConn(wsConn)
+	c.health.reach(StageTransport)
 	// perform SSH handshake on net.Conn
 	c.Debugf("Handshaking...")
-	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
+	sshConfig := *c.sshConfig
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return c.verifyServer(ctx, key)
+	}
+	//cancelling mid-handshake closes the conn
+	handshook := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshook:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", &sshConfig)
+	close(handshook)
 	if err != nil {
 		if strings.Contains(err.Error(), "unable to authenticate") {
 			c.Infof("Authentication failed")
@@ -267,26 +1138,84 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 		return false, retry, err
 	}
 	defer sshConn.Close()
+	c.health.reach(StageSSH)
 	// chisel client handshake (reverse of server handshake)
 	// send configuration
 	c.Debugf("Sending config")
+	c.remotesMut.Lock()
+	config := settings.EncodeConfig(c.computed)
+	c.remotesMut.Unlock()
 	t0 := time.Now()
-	_, configerr, err := sshConn.SendRequest(
-		"config",
-		true,
-		settings.EncodeConfig(c.computed),
-	)
+	ok, reply, err := sshConn.SendRequest("config", true, config)
 	if err != nil {
 		c.Infof("Config verification failed")
 		return false, false, err
 	}
-	if len(configerr) > 0 {
-		return false, false, errors.New(string(configerr))
+	if configerr := reply; !ok {
+		err := errors.New(string(configerr))
+		if strings.Contains(err.Error(), settings.ReverseBindError) {
+			return false, true, &reverseBindError{err}
+		}
+		if s := string(configerr); strings.HasPrefix(s, settings.RedirectPrefix) {
+			return false, true, &redirectError{server: strings.TrimPrefix(s, settings.RedirectPrefix)}
+		}
+		return false, false, err
+	}
+	cr, err := settings.DecodeConfigReply(reply)
+	if err != nil {
+		return false, false, err
+	}
+	c.tunnel.SetRemoteIDs(cr.RemoteIDs)
+	c.setAlternatePorts(cr.Ports)
+	if f := c.config.OnRemoteBound; f != nil {
+		go c.reverseBound(f)
+	}
+	latency := time.Since(t0)
+	if cr.Time != 0 {
+		c.measureClockSkew(cr.Time, t0, latency)
+	}
+	c.health.reach(StageConnected)
+	c.Infof("Connected (Latency %s)", latency)
+	c.event(Event{Event: EventConnected, Latency: float64(latency) / float64(time.Millisecond)})
+	c.health.connect()
+	defer c.health.disconnect()
+	c.connectedOnce.Do(func() { close(c.connected) })
+	if f := c.config.OnAuthenticated; f != nil {
+		go f(AuthInfo{
+			Server:      c.serverURL(),
+			RemoteAddr:  sshConn.RemoteAddr().String(),
+			Fingerprint: c.serverFingerprint(),
+			User:        c.sshConfig.User,
+			SessionID:   fmt.Sprintf("%x", sshConn.SessionID()),
+			Time:        time.Now(),
+		})
+	}
+	//renew the session once the reconnect interval elapses
+	if d := c.config.ReconnectInterval; d > 0 {
+		renew := time.AfterFunc(d, func() {
+			c.Infof("Reconnect interval reached, reconnecting")
+			sshConn.Close()
+		})
+		defer renew.Stop()
+	}
+	//disconnect while idle
+	idled := int32(0)
+	if d := c.config.IdleDisconnect; d > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go c.idleLoop(sshConn, d, stop, &idled)
 	}
-	c.Infof("Connected (Latency %s)", time.Since(t0))
 	//connected, handover ssh connection for tunnel to use, and block
 	retry = true
 	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
+	if atomic.LoadInt32(&idled) == 1 {
+		c.Infof("Disconnected (idle for %s), reconnecting on demand", c.config.IdleDisconnect)
+		return true, true, errIdle
+	}
+	if err == websocket.ErrReadLimit {
+		err = fmt.Errorf("server sent a message larger than MaxMessageSize (%d bytes)", c.config.MaxMessageSize)
+		c.Infof("Connection error: %s", err)
+	}
 	if n, ok := err.(net.Error); ok && !n.Temporary() {
 		retry = false
 	}
@@ -294,12 +1223,325 @@ func (c *Client) connectionOnce(ctx context.Context) (connected, retry bool, err
 	return true, retry, err
 }
 
+//errIdle is returned by connectionOnce
+//after an IdleDisconnect
+var errIdle = errors.New("idle")
+
+//idleLoop closes sshConn once the tunnel has had no open
+//connections for the idle duration, setting idled
+func (c *Client) idleLoop(sshConn ssh.Conn, idle time.Duration, stop <-chan struct{}, idled *int32) {
+	tick := idle / 10
+	if tick > time.Second {
+		tick = time.Second
+	} else if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	_, last := c.tunnel.Activity()
+	since := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		busy, opened := c.tunnel.Activity()
+		if busy || opened != last {
+			last, since = opened, time.Now()
+			continue
+		}
+		if time.Since(since) >= idle {
+			//demand from now on reconnects
+			c.tunnel.ClearDemand()
+			atomic.StoreInt32(idled, 1)
+			sshConn.Close()
+			return
+		}
+	}
+}
+
+//reverseBindError is returned by connectionOnce
+//when the server fails to bind a reverse remote
+type reverseBindError struct {
+	error
+}
+
+//maxRedirects in a row, without connecting, bounds redirect loops
+const maxRedirects = 5
+
+//redirectError is returned by connectionOnce when
+//the server redirects the client to another server
+type redirectError struct {
+	server string
+}
+
+func (r *redirectError) Error() string {
+	return "redirected to " + r.server
+}
+
+//follow the redirect, it's used until a connection to it fails
+func (c *Client) follow(r *redirectError) error {
+	u, err := url.Parse(r.server)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid redirect URL (%s)", r.server)
+	}
+	if u.Port() == "" {
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":80"
+		}
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("invalid redirect URL (%s)", r.server)
+	}
+	c.serverMut.Lock()
+	c.redirect = u.String()
+	c.serverMut.Unlock()
+	c.Infof("Redirected to %s", u)
+	return nil
+}
+
+//unfollow returns to the configured server
+func (c *Client) unfollow() {
+	c.serverMut.Lock()
+	defer c.serverMut.Unlock()
+	if c.redirect != "" {
+		c.Infof("Returning to %s", c.server)
+		c.redirect = ""
+	}
+}
+
+//ProxyError is returned when the outbound proxy itself can't be
+//reached (e.g. a sidecar which isn't up yet), as opposed to the
+//server. These are retried quickly, without growing the backoff.
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s unreachable: %s", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+//DNSError is returned when the server's hostname can't be
+//resolved. These are usually brief, so are first retried on a
+//shorter schedule, without growing the normal backoff.
+type DNSError struct {
+	Err *net.DNSError
+}
+
+func (e *DNSError) Error() string {
+	return fmt.Sprintf("dns error: %s", e.Err)
+}
+
+func (e *DNSError) Unwrap() error {
+	return e.Err
+}
+
+//dnsError classifies resolution failures of err as DNSErrors
+func dnsError(err error) error {
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return &DNSError{Err: de}
+	}
+	return err
+}
+
+//proxyRetryInterval caps the delay between
+//attempts when the proxy is unreachable
+const proxyRetryInterval = time.Second
+
+//proxyDialer dials the proxy, classifying failures as ProxyErrors
+type proxyDialer struct {
+	proxy string
+}
+
+func (p proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+func (p proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &ProxyError{Proxy: p.proxy, Err: err}
+	}
+	return conn, nil
+}
+
+//dialWebSocket connects to the server, optionally via the proxy
+func (c *Client) dialWebSocket(ctx context.Context) (conn net.Conn, retry bool, err error) {
+	//prepare dialer
+	d := websocket.Dialer{
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     []string{chshare.ProtocolVersion},
+		TLSClientConfig:  c.tlsConfig,
+	}
+	//optional proxy
+	if p := c.proxyURL; p != nil {
+		if err := c.setProxy(p, &d); err != nil {
+			return nil, false, err
+		}
+	} else {
+		d.NetDialContext = c.dialResolved
+	}
+	//trace the stages reached
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn != nil {
+				c.health.reach(StageTCP)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				c.health.reach(StageTLS)
+			}
+		},
+	}
+	wsConn, err := c.dialServer(httptrace.WithClientTrace(ctx, trace), &d)
+	if err != nil {
+		//surface proxy failures wrapped by the dialers
+		var pe *ProxyError
+		if errors.As(err, &pe) {
+			return nil, true, pe
+		}
+		return nil, true, dnsError(err)
+	}
+	if n := c.config.MaxMessageSize; n > 0 {
+		wsConn.SetReadLimit(n)
+	}
+	if d := c.config.WebSocketPing; d > 0 {
+		return cnet.NewPingingWebSocketConn(wsConn, d, c.config.WebSocketPingTimeout), true, nil
+	}
+	return cnet.NewWebSocketConn(wsConn), true, nil
+}
+
+//dialURL dials a websocket URL, with the Headers and UserAgent,
+//checking the handshake response has the ExpectServerHeaders
+func (c *Client) dialURL(ctx context.Context, d *websocket.Dialer, u string) (*websocket.Conn, error) {
+	headers := c.config.Headers
+	if ua := c.config.UserAgent; ua != "" {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set("User-Agent", ua)
+	}
+	wsConn, resp, err := d.DialContext(ctx, u, headers)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.config.ExpectServerHeaders {
+		got, ok := resp.Header[http.CanonicalHeaderKey(k)]
+		if !ok {
+			wsConn.Close()
+			return nil, fmt.Errorf("Server response is missing the expected header '%s'", k)
+		}
+		if v != "" && (len(got) == 0 || got[0] != v) {
+			wsConn.Close()
+			return nil, fmt.Errorf("Server response header '%s' is '%s', expected '%s'", k, strings.Join(got, ", "), v)
+		}
+	}
+	return wsConn, nil
+}
+
+//dialServer dials the server URL, while PreferTLS is undecided,
+//a failed wss dial falls back to ws, the first successful
+//dial decides the URL for future connections
+func (c *Client) dialServer(ctx context.Context, d *websocket.Dialer) (*websocket.Conn, error) {
+	c.serverMut.Lock()
+	server, fallback, redirect := c.server, c.fallback, c.redirect
+	c.serverMut.Unlock()
+	if redirect != "" {
+		return c.dialURL(ctx, d, redirect)
+	}
+	wsConn, err := c.dialURL(ctx, d, server)
+	if fallback == "" {
+		return wsConn, err
+	}
+	if err != nil {
+		tlsErr := err
+		wsConn, err = c.dialURL(ctx, d, fallback)
+		if err != nil {
+			return nil, err
+		}
+		c.Infof("Warning: TLS connection failed (%s), falling back to plaintext %s", tlsErr, fallback)
+		server = fallback
+	}
+	c.serverMut.Lock()
+	c.server, c.fallback = server, ""
+	c.serverMut.Unlock()
+	return wsConn, nil
+}
+
+//dialResolved dials the server, after resolving its hostname
+func (c *Client) dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{}
+	lookup := c.config.LookupHost
+	if lookup == nil && !c.config.RotateServerAddrs {
+		//resolved by the dialer, which isn't cached
+		return d.DialContext(ctx, network, addr)
+	}
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupHost
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host}
+	}
+	if c.config.RotateServerAddrs {
+		c.serverMut.Lock()
+		i := c.addrIndex % len(addrs)
+		c.serverMut.Unlock()
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(addrs[i], port))
+		if err != nil {
+			c.serverMut.Lock()
+			c.addrIndex = i + 1
+			c.serverMut.Unlock()
+			return nil, err
+		}
+		return conn, nil
+	}
+	for i, a := range addrs {
+		//each address gets a share of the remaining
+		//time, as with the dialer's own addresses
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			actx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		}
+		var conn net.Conn
+		conn, err = d.DialContext(actx, network, net.JoinHostPort(a, port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
 func (c *Client) setProxy(u *url.URL, d *websocket.Dialer) error {
+	forward := proxyDialer{proxy: u.Host}
 	// CONNECT proxy
 	if !strings.HasPrefix(u.Scheme, "socks") {
 		d.Proxy = func(*http.Request) (*url.URL, error) {
 			return u, nil
 		}
+		//all dials are to the proxy
+		d.NetDialContext = forward.DialContext
 		return nil
 	}
 	// SOCKS5 proxy
@@ -317,7 +1559,7 @@ func (c *Client) setProxy(u *url.URL, d *websocket.Dialer) error {
 			Password: pass,
 		}
 	}
-	socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
 	if err != nil {
 		return err
 	}
@@ -325,6 +1567,79 @@ func (c *Client) setProxy(u *url.URL, d *websocket.Dialer) error {
 	return nil
 }
 
+//Ping measures the round trip time to the server now, returning
+//an error when disconnected or once the context is done
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	return c.tunnel.Ping(ctx)
+}
+
+//SetKeepAlive changes the keepalive interval while running, for
+//example to detect dead connections sooner on a less reliable
+//network, it applies from the pending keepalive onwards
+func (c *Client) SetKeepAlive(d time.Duration) {
+	c.tunnel.SetKeepAlive(d)
+}
+
+//SendRequest sends a custom SSH global request to the server,
+//waiting for its reply, see the server's RequestHandlers
+func (c *Client) SendRequest(name string, payload []byte) (bool, []byte, error) {
+	return c.tunnel.SendRequest(name, payload)
+}
+
+//Latency is the round trip time of the most recent
+//keepalive, or zero when unknown or disconnected
+func (c *Client) Latency() time.Duration {
+	return c.tunnel.Latency()
+}
+
+//RecentLogs returns up to n of the most recent log lines (oldest
+//first), this requires Config.LogBufferSize to be set
+func (c *Client) RecentLogs(n int) []string {
+	if c.logs == nil {
+		return nil
+	}
+	return c.logs.Last(n)
+}
+
+//Stats returns a snapshot of the client's tunnel counters
+func (c *Client) Stats() tunnel.Stats {
+	return c.tunnel.Stats()
+}
+
+//Connections returns the open tcp connections of the
+//client's remotes, including those of reverse remotes
+func (c *Client) Connections() []tunnel.ConnInfo {
+	return c.tunnel.Connections()
+}
+
+//CloseConnection closes an open connection, by its ConnInfo ID
+func (c *Client) CloseConnection(id string) error {
+	return c.tunnel.CloseConnection(id)
+}
+
+//Config returns a copy of the client's effective configuration
+func (c *Client) Config() EffectiveConfig {
+	e := EffectiveConfig{
+		Server:            c.serverURL(),
+		Headers:           c.config.Headers.Clone(),
+		KeepAlive:         c.config.KeepAlive,
+		MaxRetryCount:     c.config.MaxRetryCount,
+		MaxRetryInterval:  c.config.MaxRetryInterval,
+		DialTimeout:       c.config.DialTimeout,
+		MaxRemotes:        c.config.MaxRemotes,
+		MaxReverseRemotes: c.config.MaxReverseRemotes,
+	}
+	if c.proxyURL != nil {
+		e.Proxy = c.proxyURL.String()
+	}
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	for _, r := range c.computed.Remotes {
+		e.Remotes = append(e.Remotes, r.Encode())
+	}
+	return e
+}
+
 //Wait blocks while the client is running.
 func (c *Client) Wait() error {
 	return c.eg.Wait()
@@ -0,0 +1,164 @@
+package chclient
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+)
+
+//eventBuffer is the number of events queued for writing,
+//further events are dropped rather than block the client
+const eventBuffer = 256
+
+//Event is a line of the EventLogFile
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	//Server is the websocket URL
+	Server string `json:"server"`
+	//Latency of the connection handshake, in milliseconds
+	Latency float64 `json:"latency_ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	//Attempt is the retry number, since starting or the
+	//last connection (fast retries aren't counted)
+	Attempt int `json:"attempt,omitempty"`
+	//Stage reached by a failed attempt, see Client.LastStage
+	Stage ConnectStage `json:"stage,omitempty"`
+}
+
+//Event types
+const (
+	EventConnecting    = "connecting"
+	EventConnected     = "connected"
+	EventConnectFailed = "connect-failed"
+	EventDisconnected  = "disconnected"
+	EventRetrying      = "retrying"
+	EventStopped       = "stopped"
+)
+
+//recentErrorCount is the number of failed
+//connection events kept for a Snapshot
+const recentErrorCount = 10
+
+//recentErrors are the last events with an Error,
+//kept whether or not there's an EventLogFile
+type recentErrors struct {
+	mut    sync.Mutex
+	events []Event
+}
+
+func (r *recentErrors) add(ev Event) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.events = append(r.events, ev)
+	if n := len(r.events); n > recentErrorCount {
+		r.events = r.events[n-recentErrorCount:]
+	}
+}
+
+func (r *recentErrors) list() []Event {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+//eventLog appends Events as JSON lines to a file,
+//reopening it when rotated (moved or truncated)
+type eventLog struct {
+	*cio.Logger
+	path   string
+	events chan Event
+	once   sync.Once
+	file   *os.File
+	size   int64
+	failed bool
+}
+
+func newEventLog(l *cio.Logger, path string) (*eventLog, error) {
+	e := &eventLog{
+		Logger: l,
+		path:   path,
+		events: make(chan Event, eventBuffer),
+	}
+	//checked now, then opened by run
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	e.file.Close()
+	e.file = nil
+	return e, nil
+}
+
+func (e *eventLog) open() error {
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if e.file != nil {
+		e.file.Close()
+	}
+	e.file, e.size = f, info.Size()
+	return nil
+}
+
+//emit queues an event, nil eventLogs discard them
+func (e *eventLog) emit(ev Event) {
+	if e == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case e.events <- ev:
+	default:
+		//full, the writer is stuck
+	}
+}
+
+//run writes queued events until close
+func (e *eventLog) run() {
+	for ev := range e.events {
+		b, err := json.Marshal(ev)
+		if err == nil {
+			err = e.write(append(b, '\n'))
+		}
+		if err != nil && !e.failed {
+			e.Infof("Failed to write event log: %s", err)
+		}
+		e.failed = err != nil
+	}
+	if e.file != nil {
+		e.file.Close()
+	}
+}
+
+func (e *eventLog) write(b []byte) error {
+	//first write or rotated?
+	info, err := os.Stat(e.path)
+	if e.file == nil {
+		err = os.ErrNotExist
+	}
+	if cur, serr := e.file.Stat(); err != nil || serr != nil || !os.SameFile(info, cur) || info.Size() < e.size {
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	n, err := e.file.Write(b)
+	e.size += int64(n)
+	return err
+}
+
+//close stops run once the queued events are written
+func (e *eventLog) close() {
+	if e == nil {
+		return
+	}
+	e.once.Do(func() { close(e.events) })
+}
@@ -0,0 +1,283 @@
+package chclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//clockSkewWarning is the skew beyond which a warning is logged,
+//as it may explain certificate or token validation failures
+const clockSkewWarning = 30 * time.Second
+
+//HealthSnapshot combines the client's recent latency, reconnects
+//and errors into a 0-100 Score, along with its raw components
+type HealthSnapshot struct {
+	Connected bool
+	//Latency is the most recent keepalive round trip time,
+	//SmoothedLatency is a moving average of them
+	Latency         time.Duration
+	SmoothedLatency time.Duration
+	//ReconnectsPerHour counts reconnects during the last hour
+	ReconnectsPerHour int
+	//PingFailureRate is the recent fraction of failed keepalives,
+	//ConnectFailureRate the fraction of failed connection attempts
+	//during the last hour (both from 0 to 1)
+	PingFailureRate    float64
+	ConnectFailureRate float64
+	Score              int
+}
+
+//Health returns the current HealthSnapshot. Latency is sampled
+//by keepalives, so requires a KeepAlive interval.
+func (c *Client) Health() HealthSnapshot {
+	h := HealthSnapshot{
+		Latency:         c.tunnel.Latency(),
+		SmoothedLatency: c.tunnel.SmoothedLatency(),
+		PingFailureRate: c.tunnel.PingFailureRate(),
+	}
+	c.health.mut.Lock()
+	c.health.trim(time.Now())
+	h.Connected = !c.health.since.IsZero()
+	h.ReconnectsPerHour = len(c.health.connects)
+	if h.ReconnectsPerHour > 0 && c.health.connects[0].Equal(c.health.first) {
+		//the initial connection isn't a reconnect
+		h.ReconnectsPerHour--
+	}
+	if n := len(c.health.connects) + len(c.health.failures); n > 0 {
+		h.ConnectFailureRate = float64(len(c.health.failures)) / float64(n)
+	}
+	c.health.mut.Unlock()
+	h.Score = h.score()
+	return h
+}
+
+func (h HealthSnapshot) score() int {
+	if !h.Connected {
+		return 0
+	}
+	score := 100.0
+	//lose a point per 10ms beyond 100ms, up to 40
+	if ms := float64(h.SmoothedLatency) / float64(time.Millisecond); ms > 100 {
+		score -= min((ms-100)/10, 40)
+	}
+	//lose 10 points per reconnect, up to 30
+	score -= min(float64(10*h.ReconnectsPerHour), 30)
+	//lose up to 30 points for errors
+	score -= 30 * max(h.PingFailureRate, h.ConnectFailureRate)
+	return int(score + 0.5)
+}
+
+//ConnectedSince is when the current connection was
+//established, zero while disconnected
+func (c *Client) ConnectedSince() time.Time {
+	c.health.mut.Lock()
+	defer c.health.mut.Unlock()
+	return c.health.since
+}
+
+//Uptime is the duration of the current connection,
+//zero while disconnected
+func (c *Client) Uptime() time.Duration {
+	since := c.ConnectedSince()
+	if since.IsZero() {
+		return 0
+	}
+	return time.Since(since)
+}
+
+//HealthHandler serves health checks for liveness and readiness
+//probes. Paths ending in /live report whether the client is still
+//running (its connection loop hasn't stopped, for example after the
+//MaxRetryCount), any other path reports whether it's connected (or
+//idle, see IdleDisconnect). Both reply 200 or 503 with a JSON body
+//of the client's state.
+func (c *Client) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.health.mut.Lock()
+		status := struct {
+			Connected bool    `json:"connected"`
+			Running   bool    `json:"running"`
+			Idle      bool    `json:"idle"`
+			Uptime    float64 `json:"uptime_seconds"`
+			Latency   float64 `json:"latency_ms"`
+			//LastStage of the last connection attempt
+			LastStage ConnectStage `json:"last_stage"`
+		}{
+			Connected: !c.health.since.IsZero(),
+			Running:   !c.health.stopped,
+			Idle:      c.health.idle,
+			LastStage: c.health.stage,
+		}
+		if status.Connected {
+			status.Uptime = time.Since(c.health.since).Seconds()
+		}
+		c.health.mut.Unlock()
+		status.Latency = float64(c.tunnel.Latency()) / float64(time.Millisecond)
+		ok := status.Connected || status.Idle
+		if strings.HasSuffix(r.URL.Path, "/live") {
+			ok = status.Running
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+//ClockSkew estimates how far the server's clock is ahead of
+//(or, when negative, behind) the client's, measured once per
+//connection, it's zero until measured
+func (c *Client) ClockSkew() time.Duration {
+	c.health.mut.Lock()
+	defer c.health.mut.Unlock()
+	return c.health.skew
+}
+
+//measureClockSkew compares the server's time from the config
+//reply, assumed to be read halfway through the round trip, with our own
+func (c *Client) measureClockSkew(nanos int64, t0 time.Time, rtt time.Duration) {
+	skew := time.Unix(0, nanos).Sub(t0.Add(rtt / 2))
+	c.health.mut.Lock()
+	c.health.skew = skew
+	c.health.mut.Unlock()
+	if skew > clockSkewWarning || skew < -clockSkewWarning {
+		c.Infof("Warning: server clock differs by %s", skew.Round(time.Second))
+	} else {
+		c.Debugf("Clock skew %s", skew)
+	}
+}
+
+//ConnectStage is how far a connection attempt got
+type ConnectStage string
+
+//Connection stages, in order
+const (
+	//StageNone is a failed dial, of the server or its proxy
+	StageNone ConnectStage = ""
+	//StageTCP is a tcp connection to the server, or its proxy
+	StageTCP ConnectStage = "tcp"
+	//StageTLS is a completed TLS handshake with a wss server
+	StageTLS ConnectStage = "tls"
+	//StageTransport is an upgraded WebSocket (or a
+	//ConnFactory conn), the server is reachable
+	StageTransport ConnectStage = "transport"
+	//StageSSH is a completed SSH handshake, including auth
+	StageSSH ConnectStage = "ssh"
+	//StageConnected is an accepted config
+	StageConnected ConnectStage = "connected"
+)
+
+//reachedServer is a stage where the server itself answered
+func (s ConnectStage) reachedServer() bool {
+	return s == StageTransport || s == StageSSH
+}
+
+//Idle reports whether the client disconnected after the
+//IdleDisconnect, and will reconnect on demand
+func (c *Client) Idle() bool {
+	c.health.mut.Lock()
+	defer c.health.mut.Unlock()
+	return c.health.idle
+}
+
+//LastStage is how far the last connection attempt got, which
+//tells an unreachable server from one rejecting the client
+func (c *Client) LastStage() ConnectStage {
+	c.health.mut.Lock()
+	defer c.health.mut.Unlock()
+	return c.health.stage
+}
+
+//clientHealth records the current connection
+//and connection attempts during the last hour
+type clientHealth struct {
+	mut      sync.Mutex
+	since    time.Time
+	first    time.Time
+	connects []time.Time
+	failures []time.Time
+	//server clock skew, see ClockSkew
+	skew time.Duration
+	//stopped once the connection loop returns
+	stopped bool
+	//stage of the current attempt, see LastStage
+	stage ConnectStage
+	//idle after an IdleDisconnect
+	idle bool
+}
+
+func (h *clientHealth) setIdle(idle bool) {
+	h.mut.Lock()
+	h.idle = idle
+	h.mut.Unlock()
+}
+
+func (h *clientHealth) reach(s ConnectStage) {
+	h.mut.Lock()
+	h.stage = s
+	h.mut.Unlock()
+}
+
+func (h *clientHealth) connect() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	now := time.Now()
+	if h.first.IsZero() {
+		h.first = now
+	}
+	h.since = now
+	h.connects = append(h.connects, now)
+	h.trim(now)
+}
+
+func (h *clientHealth) disconnect() {
+	h.mut.Lock()
+	h.since = time.Time{}
+	h.mut.Unlock()
+}
+
+func (h *clientHealth) stop() {
+	h.mut.Lock()
+	h.stopped = true
+	h.mut.Unlock()
+}
+
+func (h *clientHealth) fail() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	now := time.Now()
+	h.failures = append(h.failures, now)
+	h.trim(now)
+}
+
+//trim attempts older than an hour, mut must be held
+func (h *clientHealth) trim(now time.Time) {
+	h.connects = trimBefore(h.connects, now.Add(-time.Hour))
+	h.failures = trimBefore(h.failures, now.Add(-time.Hour))
+}
+
+func trimBefore(times []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(t) {
+		i++
+	}
+	return times[i:]
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
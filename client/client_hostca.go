@@ -0,0 +1,39 @@
+package chclient
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//hostCertAlgos are the host key algorithms
+//accepted with a HostCertAuthority
+var hostCertAlgos = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSAv01,
+}
+
+//verifyHostCert checks the server presented a host certificate
+//signed by the HostCertAuthority, currently valid, with the
+//server's hostname among its principals (if any are listed)
+func (c *Client) verifyHostCert(key ssh.PublicKey) error {
+	ca := c.hostCA.Marshal()
+	checker := ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), ca)
+		},
+	}
+	host := c.serverHost()
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "0")
+	}
+	if err := checker.CheckHostKey(host, nil, key); err != nil {
+		return fmt.Errorf("Invalid host certificate (%s)", err)
+	}
+	return nil
+}
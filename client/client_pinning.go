@@ -0,0 +1,62 @@
+package chclient
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+//PinStore persists server fingerprints for trust-on-first-use
+//pinning, the first fingerprint seen for a host is stored and
+//must match on all later connections
+type PinStore interface {
+	Load(host string) (fingerprint string, ok bool)
+	Store(host, fingerprint string) error
+}
+
+//knownHostsFile is the default PinStore,
+//one "<host> <fingerprint>" per line
+type knownHostsFile struct {
+	mut  sync.Mutex
+	path string
+}
+
+//NewKnownHostsFile creates a file backed PinStore,
+//the file is created on the first Store
+func NewKnownHostsFile(path string) PinStore {
+	return &knownHostsFile{path: path}
+}
+
+func (k *knownHostsFile) Load(host string) (string, bool) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	f, err := os.Open(k.path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == host {
+			return fields[1], true
+		}
+	}
+	return "", false
+}
+
+func (k *knownHostsFile) Store(host, fingerprint string) error {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	f, err := os.OpenFile(k.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, fingerprint); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
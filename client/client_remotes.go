@@ -0,0 +1,430 @@
+package chclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+//TunnelState describes a remote at runtime
+type TunnelState string
+
+const (
+	//TunnelActive remotes are bound (or requested from the server)
+	TunnelActive TunnelState = "active"
+	//TunnelDisabled remotes keep their config but have no listener
+	TunnelDisabled TunnelState = "disabled"
+	//TunnelScheduledOff remotes are outside their schedule
+	TunnelScheduledOff TunnelState = "scheduled-off"
+	//TunnelDraining remotes are bound but refuse new connections
+	TunnelDraining TunnelState = "draining"
+)
+
+//TunnelInfo describes one of the client's remotes
+type TunnelInfo struct {
+	Remote  string
+	Reverse bool
+	State   TunnelState
+	//Listeners are the local addresses (on the server when
+	//Reverse), a remote may list several local hosts
+	Listeners []string
+}
+
+//remote tracks a computed remote while the client runs
+type remote struct {
+	*settings.Remote
+	disabled bool
+	draining bool
+	proxy    *tunnel.Proxy
+	stop     func()
+	//port is the server's alternate port of a reverse remote
+	port string
+}
+
+//listeners are the addresses of the remote's listeners,
+//on the alternate port when the server bound one
+func (r *remote) listeners() []string {
+	if r.port == "" {
+		return r.Locals()
+	}
+	alt := *r.Remote
+	alt.LocalPort = r.port
+	return alt.Locals()
+}
+
+//Tunnels lists each remote and its current state
+func (c *Client) Tunnels() []TunnelInfo {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	infos := make([]TunnelInfo, len(c.remotes))
+	for i, r := range c.remotes {
+		state := TunnelActive
+		if r.disabled {
+			state = TunnelDisabled
+		} else if !r.InSchedule(time.Now()) {
+			state = TunnelScheduledOff
+		} else if r.draining {
+			state = TunnelDraining
+		}
+		infos[i] = TunnelInfo{
+			Remote:    r.String(),
+			Reverse:   r.Reverse,
+			State:     state,
+			Listeners: r.listeners(),
+		}
+	}
+	return infos
+}
+
+//setAlternatePorts records the ports the server bound
+//reverse remotes to, instead of their own, by encoded remote
+func (c *Client) setAlternatePorts(ports map[string]string) {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	for _, r := range c.remotes {
+		if !r.Reverse {
+			continue
+		}
+		r.port = ports[r.Encode()]
+		if r.port != "" {
+			c.Infof("Server bound %s to port %s, as its port is in use", r, r.port)
+		}
+	}
+}
+
+//reverseBound calls f with the server side address of
+//each listener of the bound reverse remotes
+func (c *Client) reverseBound(f func(settings.Remote, string)) {
+	type bound struct {
+		remote settings.Remote
+		addrs  []string
+	}
+	c.remotesMut.Lock()
+	all := []bound{}
+	for _, r := range c.remotes {
+		if !r.Reverse {
+			continue
+		}
+		all = append(all, bound{remote: *r.Remote, addrs: r.listeners()})
+	}
+	c.remotesMut.Unlock()
+	for _, b := range all {
+		for _, addr := range b.addrs {
+			f(b.remote, addr)
+		}
+	}
+}
+
+//DisableRemote closes the listener of the given remote, its config is
+//retained (including across reconnects) until EnableRemote is called.
+//Connections which are already open are not interrupted.
+func (c *Client) DisableRemote(spec string) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	r, err := c.findRemote(spec)
+	if err != nil {
+		return err
+	}
+	if r.Reverse {
+		return errors.New("Reverse remotes are bound by the server and cannot be disabled")
+	}
+	if r.disabled {
+		return nil
+	}
+	r.disabled = true
+	c.syncRemote(r)
+	c.Infof("Disabled remote %s", r.Remote)
+	return nil
+}
+
+//EnableRemote rebinds a remote which was disabled with DisableRemote
+func (c *Client) EnableRemote(spec string) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	r, err := c.findRemote(spec)
+	if err != nil {
+		return err
+	}
+	if !r.disabled {
+		return nil
+	}
+	r.disabled = false
+	if err := c.syncRemote(r); err != nil {
+		r.disabled = true
+		return err
+	}
+	c.Infof("Enabled remote %s", r.Remote)
+	return nil
+}
+
+//Drain stops the given local tcp remote from accepting new
+//connections, which are closed once accepted, while its listener,
+//its open connections, and the SSH connection are kept. This
+//allows a gradual cutover, unlike DisableRemote, which unbinds.
+func (c *Client) Drain(spec string) error {
+	return c.setDraining(spec, true)
+}
+
+//Undrain resumes accepting connections on a drained remote
+func (c *Client) Undrain(spec string) error {
+	return c.setDraining(spec, false)
+}
+
+func (c *Client) setDraining(spec string, draining bool) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	r, err := c.findRemote(spec)
+	if err != nil {
+		return err
+	}
+	if r.Reverse || r.Stdio || r.LocalProto != "tcp" {
+		return errors.New("Only local tcp remotes can be drained")
+	}
+	if r.draining == draining {
+		return nil
+	}
+	r.draining = draining
+	if r.proxy != nil {
+		r.proxy.SetDraining(draining)
+	}
+	if draining {
+		c.Infof("Draining remote %s", r.Remote)
+	} else {
+		c.Infof("Undrained remote %s", r.Remote)
+	}
+	return nil
+}
+
+//AddRemote adds and binds a new local remote while the client runs.
+//Remotes added after connecting are sent to the server on reconnect.
+func (c *Client) AddRemote(spec string) error {
+	return c.addRemote(spec, false)
+}
+
+//RemoveRemote closes and forgets a remote added with AddRemote
+//(or from the initial config), open connections are not interrupted
+func (c *Client) RemoveRemote(spec string) error {
+	return c.removeRemote(spec, false)
+}
+
+//addRemote decodes and binds spec, only the server may add
+//reverse remotes, since it owns their listeners
+func (c *Client) addRemote(spec string, pushed bool) error {
+	r, err := settings.DecodeRemote(spec)
+	if err != nil {
+		return fmt.Errorf("Failed to decode remote '%s': %s", spec, err)
+	}
+	if r.Reverse && !pushed {
+		return errors.New("Reverse remotes are bound by the server and cannot be added")
+	}
+	if r.Stdio || r.Schedule != "" {
+		return errors.New("Stdio and scheduled remotes cannot be added at runtime")
+	}
+	if r.Reverse && r.Socks && !c.tunnel.Socks {
+		return errors.New("Reverse socks requires a reverse socks remote at startup")
+	}
+	if r.Reverse {
+		if _, err := r.DialTLSConfig(); err != nil {
+			return err
+		}
+	}
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	duplicate, err := c.checkCollisions(r)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		return nil
+	}
+	if err := append(settings.Remotes{r}, c.computed.Remotes...).CheckLimits(c.config.MaxRemotes, c.config.MaxReverseRemotes); err != nil {
+		return err
+	}
+	rem := &remote{Remote: r}
+	if err := c.syncRemote(rem); err != nil {
+		return err
+	}
+	if r.Reverse {
+		c.tunnel.AddOutboundRemote(r)
+	}
+	c.computed.Remotes = append(c.computed.Remotes, r)
+	c.remotes = append(c.remotes, rem)
+	c.Infof("Added remote %s", r)
+	return nil
+}
+
+//removeRemote unbinds and forgets spec
+func (c *Client) removeRemote(spec string, pushed bool) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	r, err := c.findRemote(spec)
+	if err != nil {
+		return err
+	}
+	if r.Reverse && !pushed {
+		return errors.New("Reverse remotes are bound by the server and cannot be removed")
+	}
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+	if r.Reverse {
+		c.tunnel.RemoveOutboundRemote(r.Remote)
+	}
+	remotes := []*remote{}
+	computed := settings.Remotes{}
+	for _, o := range c.remotes {
+		if o != r {
+			remotes = append(remotes, o)
+			computed = append(computed, o.Remote)
+		}
+	}
+	c.remotes = remotes
+	c.computed.Remotes = computed
+	c.Infof("Removed remote %s", r.Remote)
+	return nil
+}
+
+//requestHandlers accept remote changes pushed by the server
+func (c *Client) requestHandlers() map[string]func([]byte) (bool, []byte) {
+	handle := func(apply func(spec string, pushed bool) error) func([]byte) (bool, []byte) {
+		return func(payload []byte) (bool, []byte) {
+			if !c.config.AllowServerRemotes {
+				return false, []byte("client does not allow server remotes")
+			}
+			if err := apply(string(payload), true); err != nil {
+				c.Infof("Rejected server remote change: %s", err)
+				return false, []byte(err.Error())
+			}
+			return true, nil
+		}
+	}
+	handlers := map[string]func([]byte) (bool, []byte){}
+	for name, h := range c.config.RequestHandlers {
+		handlers[name] = h
+	}
+	//built-in handlers take precedence
+	handlers[settings.RemoteAddRequest] = handle(c.addRemote)
+	handlers[settings.RemoteRemoveRequest] = handle(c.removeRemote)
+	return handlers
+}
+
+//bindRemotes binds all enabled local remotes,
+//any failures are combined into a single error
+func (c *Client) bindRemotes(ctx context.Context) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	c.runCtx = ctx
+	failed := []string{}
+	for _, r := range c.remotes {
+		if err := c.syncRemote(r); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to bind %d remote(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+//scheduleLoop binds and unbinds scheduled remotes
+//as they enter and leave their windows
+func (c *Client) scheduleLoop(ctx context.Context) error {
+	for {
+		//windows have minute granularity
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-time.After(next.Sub(now)):
+		case <-ctx.Done():
+			return nil
+		}
+		c.remotesMut.Lock()
+		for _, r := range c.remotes {
+			if r.Schedule == "" {
+				continue
+			}
+			bound := r.stop != nil
+			if err := c.syncRemote(r); err != nil {
+				c.Infof("Failed to bind scheduled remote %s: %s", r.Remote, err)
+			} else if !bound && r.stop != nil {
+				c.Infof("Remote %s entered its schedule", r.Remote)
+			} else if bound && r.stop == nil {
+				c.Infof("Remote %s left its schedule", r.Remote)
+			}
+		}
+		c.remotesMut.Unlock()
+	}
+}
+
+//syncRemote binds or unbinds a local remote according to its
+//enabled state and schedule. remotesMut must be held.
+func (c *Client) syncRemote(r *remote) error {
+	if r.Reverse || c.runCtx == nil {
+		return nil
+	}
+	want := !r.disabled && r.InSchedule(time.Now())
+	if want && r.stop == nil {
+		return c.bindRemote(c.runCtx, r)
+	}
+	if !want && r.stop != nil {
+		r.stop()
+		r.stop = nil
+		r.proxy = nil
+	}
+	return nil
+}
+
+//bindRemote listens on r and runs its proxy in the
+//background until the client closes or r is disabled.
+//remotesMut must be held.
+func (c *Client) bindRemote(ctx context.Context, r *remote) error {
+	if isDone(ctx) {
+		return errors.New("client closed")
+	}
+	p, err := c.tunnel.Listen(r.Remote)
+	if err != nil {
+		return err
+	}
+	p.SetDraining(r.draining)
+	r.proxy = p
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	r.stop = func() {
+		cancel()
+		<-done
+	}
+	c.eg.Go(func() error {
+		defer close(done)
+		return p.Run(ctx)
+	})
+	return nil
+}
+
+//findRemote by its spec, remotesMut must be held
+func (c *Client) findRemote(spec string) (*remote, error) {
+	d, err := settings.DecodeRemote(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode remote '%s': %s", spec, err)
+	}
+	for _, r := range c.remotes {
+		if r.Encode() == d.Encode() {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("Remote '%s' not found", spec)
+}
+
+func isDone(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,122 @@
+package chclient
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+//DiagnosticSnapshot is the client's state in one JSON serializable
+//struct, for bug reports, see Snapshot. Durations are nanoseconds.
+type DiagnosticSnapshot struct {
+	Time    time.Time
+	Version string
+	//Config is the EffectiveConfig, with the values of credential
+	//headers, and the userinfo and query values of the server and
+	//proxy URLs, redacted (see redactURL)
+	Config EffectiveConfig
+	//Running is false once the connection loop has stopped,
+	//as reported by HealthHandler
+	Running        bool
+	Idle           bool
+	LastStage      ConnectStage
+	ConnectedSince time.Time
+	Uptime         time.Duration
+	ClockSkew      time.Duration
+	Health         HealthSnapshot
+	Tunnels        []TunnelInfo
+	Connections    []tunnel.ConnInfo
+	Stats          tunnel.Stats
+	//RecentErrors are the last Events with an Error (failed
+	//connections, disconnects), oldest first, with or
+	//without an EventLogFile
+	RecentErrors []Event
+	//RecentLogs requires Config.LogBufferSize
+	RecentLogs []string
+}
+
+//recentLogCount is the number of log lines in a Snapshot
+const recentLogCount = 100
+
+//redacted replaces secrets in a DiagnosticSnapshot
+const redacted = "REDACTED"
+
+//credentialHeaders are the Headers whose values are redacted
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+//Snapshot gathers the client's config, connection state and counters
+//into a DiagnosticSnapshot, it's safe to call at any time, including
+//before Start, while disconnected and after Close
+func (c *Client) Snapshot() DiagnosticSnapshot {
+	s := DiagnosticSnapshot{
+		Time:           time.Now(),
+		Version:        chshare.BuildVersion,
+		Config:         c.Config(),
+		Idle:           c.Idle(),
+		LastStage:      c.LastStage(),
+		ConnectedSince: c.ConnectedSince(),
+		Uptime:         c.Uptime(),
+		ClockSkew:      c.ClockSkew(),
+		Health:         c.Health(),
+		Tunnels:        c.Tunnels(),
+		Connections:    c.Connections(),
+		Stats:          c.Stats(),
+		RecentErrors:   c.recentErrs.list(),
+		RecentLogs:     c.RecentLogs(recentLogCount),
+	}
+	c.health.mut.Lock()
+	s.Running = !c.health.stopped
+	c.health.mut.Unlock()
+	for _, h := range credentialHeaders {
+		if _, ok := s.Config.Headers[http.CanonicalHeaderKey(h)]; ok {
+			s.Config.Headers.Set(h, redacted)
+		}
+	}
+	//the urls are also logged, and in the events
+	var replace []string
+	for _, u := range []*string{&s.Config.Server, &s.Config.Proxy} {
+		if r := redactURL(*u); r != *u {
+			replace = append(replace, *u, r)
+			*u = r
+		}
+	}
+	if len(replace) > 0 {
+		r := strings.NewReplacer(replace...)
+		for i, l := range s.RecentLogs {
+			s.RecentLogs[i] = r.Replace(l)
+		}
+		for i, ev := range s.RecentErrors {
+			s.RecentErrors[i].Server = r.Replace(ev.Server)
+			s.RecentErrors[i].Error = r.Replace(ev.Error)
+		}
+	}
+	return s
+}
+
+//redactURL replaces the password of a URL's userinfo (or the
+//username, when there's no password) and its query values
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		} else {
+			u.User = url.User(redacted)
+		}
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{redacted}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,68 @@
+package chclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//tlsVersions by MinTLSVersion name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//tlsCipherSuites by IANA name, these are the TLS 1.0-1.2
+//suites, crypto/tls doesn't allow TLS 1.3 suites to be chosen
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+//serverTLSConfig of the wss connection to the server,
+//nil when neither MinTLSVersion nor TLSCipherSuites are set
+func (c *Config) serverTLSConfig() (*tls.Config, error) {
+	if c.MinTLSVersion == "" && len(c.TLSCipherSuites) == 0 {
+		return nil, nil
+	}
+	t := &tls.Config{}
+	if v := c.MinTLSVersion; v != "" {
+		min, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid MinTLSVersion '%s', expected one of %s", v, names(tlsVersions))
+		}
+		t.MinVersion = min
+	}
+	for _, s := range c.TLSCipherSuites {
+		id, ok := tlsCipherSuites[s]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS cipher suite '%s', expected one of %s", s, names(tlsCipherSuites))
+		}
+		t.CipherSuites = append(t.CipherSuites, id)
+	}
+	return t, nil
+}
+
+func names(m map[string]uint16) string {
+	s := make([]string, 0, len(m))
+	for n := range m {
+		s = append(s, n)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
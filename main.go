@@ -132,6 +132,14 @@ var serverHelp = `
     specify a time with a unit, for example '5s' or '2m'. Defaults
     to '25s' (set to 0s to disable).
 
+    --ws-ping, An optional interval of WebSocket ping frames sent to each
+    client, which disconnect it when their pong isn't received within
+    --ws-ping-timeout (defaults to the interval). Some load balancers
+    and proxies (e.g. an AWS ALB, 60s by default) close WebSockets
+    without frames for their idle timeout, as the SSH keepalives inside
+    aren't visible to them. If connections drop after a fixed idle
+    period, set this below it, for example '30s'. Defaults to 0 (disabled).
+
     --proxy, Specifies another HTTP server to proxy requests to when
     chisel receives a normal HTTP request. Useful for hiding chisel in
     plain sight.
@@ -141,6 +149,24 @@ var serverHelp = `
 
     --reverse, Allow clients to specify reverse port forwarding remotes
     in addition to normal remotes.
+
+    --dial-timeout, An optional time limit for dialing the targets of
+    remotes, for example '10s'. Clients may override this per remote
+    using the timeout option. Defaults to no limit.
+
+    --tls-remote-dir, A directory of PEM files which clients may name
+    in the tls-cert and tls-key options of their reverse remotes, and
+    the tls-ca option of their normal remotes, when these are read by
+    the server. File names only, paths are refused. Without it, the
+    server refuses remotes which would have it read tls files.
+
+    --max-remotes, Limits the number of remotes each client may request,
+    and --max-reverse-remotes the number of them which are reversed.
+    Clients requesting more are refused. Defaults to 0 (no limit).
+
+    --host-cert, An optional path to an OpenSSH host certificate of the
+    server's key, presented to clients using --host-ca. Sign the public
+    key logged with -v, for example with ssh-keygen -s ca -h -n <host>.
 ` + commonHelp
 
 func server(args []string) {
@@ -152,9 +178,16 @@ func server(args []string) {
 	flags.StringVar(&config.AuthFile, "authfile", "", "")
 	flags.StringVar(&config.Auth, "auth", "", "")
 	flags.DurationVar(&config.KeepAlive, "keepalive", 25*time.Second, "")
+	flags.DurationVar(&config.WebSocketPing, "ws-ping", 0, "")
+	flags.DurationVar(&config.WebSocketPingTimeout, "ws-ping-timeout", 0, "")
 	flags.StringVar(&config.Proxy, "proxy", "", "")
 	flags.BoolVar(&config.Socks5, "socks5", false, "")
 	flags.BoolVar(&config.Reverse, "reverse", false, "")
+	flags.DurationVar(&config.DialTimeout, "dial-timeout", 0, "")
+	flags.StringVar(&config.TLSRemoteDir, "tls-remote-dir", "", "")
+	flags.IntVar(&config.MaxRemotes, "max-remotes", 0, "")
+	flags.IntVar(&config.MaxReverseRemotes, "max-reverse-remotes", 0, "")
+	flags.StringVar(&config.HostCertFile, "host-cert", "", "")
 
 	host := flags.String("host", "", "")
 	p := flags.String("p", "", "")
@@ -233,17 +266,26 @@ func (flag *headerFlags) Set(arg string) error {
 var clientHelp = `
   Usage: chisel client [options] <server> <remote> [remote] [remote] ...
 
-  <server> is the URL to the chisel server.
+  <server> is the URL to the chisel server. Any path and query are
+  kept, for servers behind path based routing (e.g. https://edge/chisel).
 
   <remote>s are remote connections tunneled through the server, each of
   which come in the form:
 
     <local-host>:<local-port>:<remote-host>:<remote-port>
 
-    ■ local-host defaults to 0.0.0.0 (all interfaces).
+    ■ local-host defaults to 0.0.0.0 (all interfaces), a comma
+      separated list of hosts binds a tcp listener on each.
     ■ local-port defaults to remote-port.
     ■ remote-port is required*.
-    ■ remote-host defaults to 0.0.0.0 (server localhost).
+    ■ remote-host defaults to 0.0.0.0 (server localhost), a comma
+      separated list of tcp hosts is a pool, each connection dials
+      one of them, failing over to the next should the dial fail.
+      Hosts may be weighted with a *<weight> suffix, for example
+      3000:web1*3,web2:80 sends 3 connections to web1 per 1 to web2.
+    ■ remote-port may be suffixed with /udp to forward udp, or with
+      /tcp+udp to forward both protocols on the same port (e.g. for
+      DNS or QUIC), binding a listener of each.
 
   which shares <remote-host>:<remote-port> from the server to the client
   as <local-host>:<local-port>, or:
@@ -270,7 +312,8 @@ var clientHelp = `
     specify "socks" in place of remote-host and remote-port.
     The default local host and port for a "socks" remote is
     127.0.0.1:1080. Connections to this remote will terminate
-    at the server's internal SOCKS5 proxy.
+    at the server's internal SOCKS5 proxy, which also accepts
+    SOCKS4 and SOCKS4a clients on the same port.
 
     When the chisel server has --reverse enabled, remotes can
     be prefixed with R to denote that they are reversed. That
@@ -280,6 +323,44 @@ var clientHelp = `
     default socks port (1080) and terminate the connection at the
     client's internal SOCKS5 proxy.
 
+    Remotes may be prefixed with options in the form <key>=<value>,
+    for example timeout=5s:3000:google.com:80. Available options:
+
+      ■ timeout, a time limit for dialing the remote-host, overriding
+        the --dial-timeout of whichever side performs the dial.
+      ■ schedule, a daily window in the form HHMM-HHMM during which
+        a local remote is bound, for example schedule=2200-0600.
+      ■ tz, the IANA time zone of the schedule (defaults to local).
+      ■ tls-cert and tls-key, PEM files used to terminate TLS on
+        the listener, forwarding plaintext through the tunnel.
+      ■ tls-ca, a PEM file of CAs used to originate TLS to the
+        remote-host. Use tls-origin=true to trust the system CAs.
+        Certificate paths are read by whichever side uses them, the
+        server only reads files from its --tls-remote-dir.
+      ■ proxy-protocol=true, prefix each connection with a PROXY protocol
+        v1 header, so the remote-host sees the original source address.
+      ■ weight, this remote's share of --max-bandwidth relative to
+        other busy remotes, for example weight=3 (defaults to 1).
+      ■ conn-rate, the new connections per second accepted by a
+        tcp listener, excess connections are delayed for up to a
+        second, then closed. See also --max-conn-rate.
+      ■ max-lifetime, close the remote's tcp connections once they've
+        been open for the given duration, regardless of activity,
+        for example max-lifetime=1h.
+      ■ nodelay, set TCP_NODELAY on the remote's tcp connections.
+        It's enabled by default, for lower latency, while nodelay=false
+        enables Nagle's algorithm, which sends fewer, fuller packets.
+      ■ balance, how a pool of remote-hosts is balanced, round-robin
+        (the default) or random, both honour the hosts' weights.
+      ■ fallback-direct=true, dial the remote-host directly from the
+        client, bypassing the tunnel, for connections accepted while
+        it's down, rather than closing them. Each is logged.
+      ■ dial-retries, retry a failed dial of the remote-host this many
+        times before closing the connection, for backends which are
+        briefly unavailable (e.g. restarting). Off by default.
+      ■ dial-backoff, the wait before the first of the dial-retries,
+        doubling after each, up to 10s (defaults to 100ms).
+
     When stdio is used as local-host, the tunnel will connect standard
     input/output of this program with the remote. This is useful when 
     combined with ssh ProxyCommand. You can use
@@ -294,19 +375,49 @@ var clientHelp = `
     You may provide just a prefix of the key or the entire string.
     Fingerprint mismatches will close the connection.
 
+    --fingerprint-file, An optional path to a file containing the
+    fingerprint. Avoids exposing it in process listings. Cannot be
+    used with --fingerprint.
+
+    --known-hosts, An optional path to a file in which to pin the server's
+    fingerprint on first use, when --fingerprint is not set. Later
+    connections to the same server must present the pinned fingerprint.
+
+    --host-ca, An optional path to the public key of an SSH CA. The server
+    must present a current host certificate signed by it (see the server's
+    --host-cert) naming the server's hostname, in place of --known-hosts.
+
     --auth, An optional username and password (client authentication)
     in the form: "<user>:<pass>". These credentials are compared to
     the credentials inside the server's --authfile. defaults to the
     AUTH environment variable.
 
+    --auth-file, An optional path to a file containing the "<user>:<pass>"
+    credentials. Avoids exposing them in process listings and shell
+    history. Cannot be used with --auth.
+
     --keepalive, An optional keepalive interval. Since the underlying
     transport is HTTP, in many instances we'll be traversing through
     proxies, often these proxies will close idle connections. You must
     specify a time with a unit, for example '5s' or '2m'. Defaults
-    to '25s' (set to 0s to disable).
-
-    --max-retry-count, Maximum number of times to retry before exiting.
-    Defaults to unlimited.
+    to '25s' (set to 0s to disable). When a keepalive goes unanswered
+    for a full interval, the server is presumed dead and the client
+    reconnects.
+
+    --ws-ping, An optional interval of WebSocket ping frames, which
+    disconnect when their pong isn't received within --ws-ping-timeout
+    (defaults to the interval). Pongs are sent by the server's WebSocket
+    layer, so they detect a dead link, while --keepalive also detects a
+    stuck server. With both set, the check with the shorter interval plus
+    timeout usually notices a dead link first. Pings also keep a WebSocket
+    open through load balancers and proxies which close it after an idle
+    timeout (e.g. an AWS ALB, 60s by default), as these don't see the SSH
+    keepalives inside it, so set it below their timeout. The server has
+    the same option. Defaults to 0 (disabled).
+
+    --max-retry-count, Maximum number of times to retry before exiting,
+    counted since the last connection. 0 exits on the first failure and
+    a negative number retries forever. Defaults to unlimited (-1).
 
     --max-retry-interval, Maximum wait time before retrying after a
     disconnection. Defaults to 5 minutes.
@@ -320,20 +431,135 @@ var clientHelp = `
     --header, Set a custom header in the form "HeaderName: HeaderContent".
     Can be used multiple times. (e.g --header "Foo: Bar" --header "Hello: World")
 
+    --user-agent, Optionally set the 'User-Agent' header of the
+    websocket upgrade request.
+
+    --expect-header, A header, in the form "HeaderName: HeaderContent",
+    the server's handshake response must have (an empty HeaderContent
+    accepts any value), such as one set by the load balancer in front
+    of the server. Connections without it fail, and are retried.
+    Can be used multiple times.
+
     --hostname, Optionally set the 'Host' header (defaults to the host
     found in the server url).
+
+    --client-id, An identity sent to the server, shown to its operators
+    (defaults to this machine's hostname).
+
+    --no-client-id, Don't send a client identity to the server.
+
+    --dial-timeout, An optional time limit for dialing the targets of
+    reverse remotes. Defaults to no limit.
+
+    --dry-run, Resolve and print the listeners and reverse tunnels which
+    would be created, then exit without binding or connecting.
+
+    --allow-server-remotes, Allow the server to add and remove remotes
+    while connected. Note, server added reverse remotes allow the server
+    to connect to hosts reachable from the client.
+
+    --reverse-bind-retries, The number of times to retry (with backoff)
+    when the server fails to bind a reverse remote, for example while its
+    port is briefly occupied during a restart. These retries don't count
+    towards --max-retry-count, further bind failures are retried like
+    other connection errors. Defaults to 0.
+
+    --max-remotes, Limits the number of remotes, including any added by
+    the server (see --allow-server-remotes), and --max-reverse-remotes
+    the number of them which are reversed. Defaults to 0 (no limit).
+
+    --request-alternate-port, Ask the server to bind a reverse remote
+    whose port is already in use (for example, by another client) to a
+    free port instead of failing, the assigned port is logged.
+
+    --event-log, An optional path to a file to which a line of JSON is
+    appended for each connection event (connecting, connected,
+    connect-failed, disconnected, retrying and stopped), as an audit
+    trail. The file is reopened when rotated.
+
+    --prefer-tls, When the server is given without a scheme, connect
+    with TLS (wss on port 443, unless a port is given) and only fall
+    back to plaintext, with a warning, if that fails. The outcome is
+    kept for reconnects.
+
+    --tls-min-version, The minimum TLS version (1.0, 1.1, 1.2 or 1.3)
+    of wss connections to the server, older versions are refused.
+
+    --tls-ciphers, A comma separated list of the TLS cipher suites
+    allowed on wss connections to the server, by IANA name, for
+    example TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites
+    can't be restricted, so this only applies to TLS 1.2 and below.
+
+    --fast-retries, Retry the given number of failed connection attempts
+    quickly (without backoff) while first connecting, to ride out races
+    during boot, such as DNS or the network not being ready yet.
+
+    --fast-retry-window, Limit --fast-retries to the given duration
+    after starting (defaults to no limit).
+
+    --reconnect-grace, Keep idle local connections open for up to the given
+    duration when the server connection is lost, bridging them to the next
+    connection. The target sees a new connection, and a request in flight
+    is resent, so this only suits idempotent request/response protocols
+    (e.g. HTTP keep-alive connections). Defaults to 0 (close immediately).
+
+    --reconnect-wait, How long new local connections wait for the server
+    while reconnecting, local listeners stay open throughout. Defaults
+    to 35s.
+
+    --idle-disconnect, Disconnect from the server after the given duration
+    without any open tunnel connections, keeping the local listeners up.
+    The next connection they accept reconnects, waiting up to
+    --reconnect-wait. Defaults to 0 (stay connected).
+
+    --max-bandwidth, Limits the total bytes per second of tcp traffic
+    across all remotes. Busy remotes share it fairly, according to their
+    weight option. Defaults to 0 (no limit).
+
+    --max-conn-rate, Limits the new connections per second accepted
+    across all local tcp listeners. Excess connections are delayed for
+    up to a second, then closed. Defaults to 0 (no limit).
 ` + commonHelp
 
 func client(args []string) {
 	flags := flag.NewFlagSet("client", flag.ContinueOnError)
 	config := chclient.Config{Headers: http.Header{}}
 	flags.StringVar(&config.Fingerprint, "fingerprint", "", "")
+	flags.StringVar(&config.FingerprintFile, "fingerprint-file", "", "")
+	flags.StringVar(&config.KnownHostsFile, "known-hosts", "", "")
+	flags.StringVar(&config.HostCertAuthorityFile, "host-ca", "", "")
 	flags.StringVar(&config.Auth, "auth", "", "")
+	flags.StringVar(&config.AuthFile, "auth-file", "", "")
 	flags.DurationVar(&config.KeepAlive, "keepalive", 25*time.Second, "")
+	flags.DurationVar(&config.WebSocketPing, "ws-ping", 0, "")
+	flags.DurationVar(&config.WebSocketPingTimeout, "ws-ping-timeout", 0, "")
 	flags.IntVar(&config.MaxRetryCount, "max-retry-count", -1, "")
 	flags.DurationVar(&config.MaxRetryInterval, "max-retry-interval", 0, "")
 	flags.StringVar(&config.Proxy, "proxy", "", "")
 	flags.Var(&headerFlags{config.Headers}, "header", "")
+	flags.StringVar(&config.UserAgent, "user-agent", "", "")
+	expectHeaders := http.Header{}
+	flags.Var(&headerFlags{expectHeaders}, "expect-header", "")
+	flags.DurationVar(&config.DialTimeout, "dial-timeout", 0, "")
+	flags.BoolVar(&config.DryRun, "dry-run", false, "")
+	flags.BoolVar(&config.AllowServerRemotes, "allow-server-remotes", false, "")
+	flags.IntVar(&config.ReverseBindRetries, "reverse-bind-retries", 0, "")
+	flags.IntVar(&config.MaxRemotes, "max-remotes", 0, "")
+	flags.IntVar(&config.MaxReverseRemotes, "max-reverse-remotes", 0, "")
+	flags.BoolVar(&config.RequestAlternatePort, "request-alternate-port", false, "")
+	flags.StringVar(&config.EventLogFile, "event-log", "", "")
+	flags.BoolVar(&config.PreferTLS, "prefer-tls", false, "")
+	flags.StringVar(&config.MinTLSVersion, "tls-min-version", "", "")
+	tlsCiphers := flags.String("tls-ciphers", "", "")
+	flags.IntVar(&config.FastRetries, "fast-retries", 0, "")
+	flags.DurationVar(&config.FastRetryWindow, "fast-retry-window", 0, "")
+	flags.DurationVar(&config.ReconnectGrace, "reconnect-grace", 0, "")
+	flags.DurationVar(&config.ReconnectWait, "reconnect-wait", 0, "")
+	flags.DurationVar(&config.IdleDisconnect, "idle-disconnect", 0, "")
+	flags.Int64Var(&config.MaxBandwidth, "max-bandwidth", 0, "")
+	flags.Float64Var(&config.MaxConnRate, "max-conn-rate", 0, "")
+	flags.StringVar(&config.ClientID, "client-id", "", "")
+	flags.BoolVar(&config.NoClientID, "no-client-id", false, "")
 	hostname := flags.String("hostname", "", "")
 	pid := flags.Bool("pid", false, "")
 	verbose := flags.Bool("v", false, "")
@@ -349,14 +575,23 @@ func client(args []string) {
 	}
 	config.Server = args[0]
 	config.Remotes = args[1:]
+	if *tlsCiphers != "" {
+		config.TLSCipherSuites = strings.Split(*tlsCiphers, ",")
+	}
 	//default auth
-	if config.Auth == "" {
+	if config.Auth == "" && config.AuthFile == "" {
 		config.Auth = os.Getenv("AUTH")
 	}
 	//move hostname onto headers
 	if *hostname != "" {
 		config.Headers.Set("Host", *hostname)
 	}
+	for k := range expectHeaders {
+		if config.ExpectServerHeaders == nil {
+			config.ExpectServerHeaders = map[string]string{}
+		}
+		config.ExpectServerHeaders[k] = expectHeaders.Get(k)
+	}
 	//ready
 	c, err := chclient.NewClient(&config)
 	if err != nil {
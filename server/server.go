@@ -3,11 +3,15 @@ package chserver
 import (
 	"context"
 	"errors"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -29,6 +33,64 @@ type Config struct {
 	Socks5    bool
 	Reverse   bool
 	KeepAlive time.Duration
+	//WebSocketPing sends WebSocket ping frames to each client every
+	//interval, closing its connection when a pong isn't received
+	//within the WebSocketPingTimeout (defaults to the interval).
+	//These frames reset the idle timers of proxies and load
+	//balancers which don't see the SSH keepalives inside.
+	WebSocketPing        time.Duration
+	WebSocketPingTimeout time.Duration
+	//DialTimeout limits outbound dials, unless
+	//the client sets a remote's timeout= option
+	DialTimeout time.Duration
+	//SlowDialThreshold logs outbound dials which take longer,
+	//StallThreshold logs writes which block for longer (a peer
+	//which stopped reading, or a congested tunnel)
+	SlowDialThreshold time.Duration
+	StallThreshold    time.Duration
+	//DialFilter is called before each outbound dial (including
+	//socks), it returns the address to dial instead, or an error
+	//to refuse the connection (e.g. a blocklist)
+	DialFilter func(ctx context.Context, remote settings.Remote, network, addr string) (string, error)
+	//ConnMiddleware wraps or inspects each connection accepted by a
+	//reverse remote, and DialMiddleware each outbound connection, the
+	//returned conn replaces the original, and nil drops it
+	ConnMiddleware func(remote settings.Remote, c net.Conn) net.Conn
+	DialMiddleware func(remote settings.Remote, c net.Conn) net.Conn
+	//CopyBufferSize is the buffer size of each direction
+	//of a tcp connection (defaults to 32KB)
+	CopyBufferSize int
+	//NoDelay sets TCP_NODELAY on the server's tcp connections,
+	//unless set by a remote's nodelay option (nil is Go's
+	//default, enabled)
+	NoDelay *bool
+	//ProfileLabels sets a pprof "remote" label on the goroutines
+	//copying each tcp connection, see runtime/pprof
+	ProfileLabels bool
+	//MaxRemotes and MaxReverseRemotes limit the number of remotes
+	//of each client, as it connects, and those added with
+	//AddClientRemote. Defaults to 0, unlimited.
+	MaxRemotes        int
+	MaxReverseRemotes int
+	//RequestHandlers handle custom SSH global requests from clients
+	//by type (see Client.SendRequest), the built-in request types
+	//take precedence and unknown types are rejected
+	RequestHandlers map[string]func(payload []byte) (ok bool, reply []byte)
+	//Redirect, when set, is called as each client connects, returning
+	//the URL of another server to send the client to (e.g. to shed
+	//load), or an empty string to accept the client. The user is
+	//empty without auth. Clients follow up to 5 redirects in a row.
+	Redirect func(user string, remoteAddr net.Addr) string
+	//TLSRemoteDir is the directory of the tls files which clients
+	//may name in their remotes' tls-cert, tls-key and tls-ca options,
+	//where the server reads them. When empty, the server refuses
+	//remotes which would have it read tls files.
+	TLSRemoteDir string
+	//HostCert is an OpenSSH host certificate of the server's key
+	//(see GetPublicKey) in authorized_keys format, or HostCertFile a
+	//file of it, presented to clients verifying it with a CA
+	HostCert     string
+	HostCertFile string
 }
 
 // Server respresent a chisel service
@@ -36,10 +98,13 @@ type Server struct {
 	*cio.Logger
 	config       *Config
 	fingerprint  string
+	publicKey    string
 	httpServer   *cnet.HTTPServer
 	reverseProxy *httputil.ReverseProxy
 	sessCount    int32
 	sessions     *settings.Users
+	activeMut    sync.Mutex
+	active       map[string]*session
 	sshConfig    *ssh.ServerConfig
 	users        *settings.UserIndex
 }
@@ -55,6 +120,7 @@ func NewServer(c *Config) (*Server, error) {
 		httpServer: cnet.NewHTTPServer(),
 		Logger:     cio.NewLogger("server"),
 		sessions:   settings.NewUsers(),
+		active:     map[string]*session{},
 	}
 	server.Info = true
 	server.users = settings.NewUserIndex(server.Logger)
@@ -82,12 +148,31 @@ func NewServer(c *Config) (*Server, error) {
 	}
 	//fingerprint this key
 	server.fingerprint = ccrypto.FingerprintKey(private.PublicKey())
+	server.publicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(private.PublicKey())))
 	//create ssh config
 	server.sshConfig = &ssh.ServerConfig{
 		ServerVersion:    "SSH-" + chshare.ProtocolVersion + "-server",
 		PasswordCallback: server.authUser,
 	}
 	server.sshConfig.AddHostKey(private)
+	//and its certificate, for clients which ask for it
+	if c.HostCertFile != "" {
+		if c.HostCert != "" {
+			return nil, server.Errorf("HostCert and HostCertFile cannot both be set")
+		}
+		b, err := ioutil.ReadFile(c.HostCertFile)
+		if err != nil {
+			return nil, server.Errorf("Failed to read HostCertFile: %s", err)
+		}
+		c.HostCert = string(b)
+	}
+	if c.HostCert != "" {
+		signer, err := hostCertSigner(private, c.HostCert)
+		if err != nil {
+			return nil, server.Errorf("Invalid HostCert (%s)", err)
+		}
+		server.sshConfig.AddHostKey(signer)
+	}
 	//setup reverse proxy
 	if c.Proxy != "" {
 		u, err := url.Parse(c.Proxy)
@@ -131,6 +216,7 @@ func (s *Server) Start(host, port string) error {
 // and can be closed by cancelling the provided context
 func (s *Server) StartContext(ctx context.Context, host, port string) error {
 	s.Infof("Fingerprint %s", s.fingerprint)
+	s.Debugf("Public key %s", s.publicKey)
 	if s.users.Len() > 0 {
 		s.Infof("User authenication enabled")
 	}
@@ -162,6 +248,29 @@ func (s *Server) GetFingerprint() string {
 	return s.fingerprint
 }
 
+// GetPublicKey is the server's public key in authorized_keys
+// format, which an SSH CA signs to issue its HostCert
+func (s *Server) GetPublicKey() string {
+	return s.publicKey
+}
+
+//hostCertSigner presents the host certificate
+//cert of the private key's public key
+func hostCertSigner(private ssh.Signer, cert string) (ssh.Signer, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert))
+	if err != nil {
+		return nil, err
+	}
+	c, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	if c.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+	return ssh.NewCertSigner(c, private)
+}
+
 // authUser is responsible for validating the ssh user / password combination
 func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	// check if user authenication is enable and it not allow all
@@ -1,7 +1,10 @@
 package chserver
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -57,6 +60,9 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	conn := cnet.NewWebSocketConn(wsConn)
+	if d := s.config.WebSocketPing; d > 0 {
+		conn = cnet.NewPingingWebSocketConn(wsConn, d, s.config.WebSocketPingTimeout)
+	}
 	// perform SSH handshake on net.Conn
 	l.Debugf("Handshaking...")
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
@@ -100,6 +106,21 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		failed(s.Errorf("invalid config"))
 		return
 	}
+	//send the client elsewhere?
+	if f := s.config.Redirect; f != nil {
+		name := ""
+		if user != nil {
+			name = user.Name
+		}
+		if u := f(name, sshConn.RemoteAddr()); u != "" {
+			l.Infof("Redirecting client to %s", u)
+			r.Reply(false, []byte(settings.RedirectPrefix+u))
+			return
+		}
+	}
+	if c.ClientID != "" {
+		l.Debugf("Client ID %q", c.ClientID)
+	}
 	//print if client and server  versions dont match
 	if c.Version != chshare.BuildVersion {
 		v := c.Version
@@ -109,6 +130,11 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		l.Infof("Client version (%s) differs from server version (%s)",
 			v, chshare.BuildVersion)
 	}
+	if err := c.Remotes.CheckLimits(s.config.MaxRemotes, s.config.MaxReverseRemotes); err != nil {
+		l.Debugf("Denied config: %s", err)
+		failed(s.Errorf("%s", err))
+		return
+	}
 	//confirm reverse tunnels are allowed
 	for _, r := range c.Remotes {
 		if r.Reverse && !s.config.Reverse {
@@ -121,33 +147,92 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	//access to the desired remotes
 	if user != nil {
 		for _, r := range c.Remotes {
-			addr := r.UserAddr()
-			if !user.HasAccess(addr) {
-				failed(s.Errorf("access to '%s' denied", addr))
-				return
+			for _, addr := range r.UserAddrs() {
+				if !user.HasAccess(addr) {
+					failed(s.Errorf("access to '%s' denied", addr))
+					return
+				}
 			}
 		}
 	}
-	//successfuly validated config!
-	r.Reply(true, nil)
+	//tls files are read from the server's disk, only
+	//those in the TLSRemoteDir may be named by clients
+	for _, r := range c.Remotes {
+		if err := s.remoteTLS(r); err != nil {
+			l.Debugf("Denied remote '%s': %s", r, err)
+			failed(s.Errorf("invalid tls options on remote '%s'", r))
+			return
+		}
+	}
 	//tunnel per ssh connection
 	tunnel := tunnel.New(tunnel.Config{
-		Logger:    l,
-		Inbound:   s.config.Reverse,
-		Outbound:  true, //server always accepts outbound
-		Socks:     s.config.Socks5,
-		KeepAlive: s.config.KeepAlive,
+		Logger:          l,
+		Inbound:         s.config.Reverse,
+		Outbound:        true, //server always accepts outbound
+		Socks:           s.config.Socks5,
+		KeepAlive:       s.config.KeepAlive,
+		DialTimeout:     s.config.DialTimeout,
+		OutboundRemotes: c.Remotes.Reversed(false),
+		RequestHandlers: s.requestHandlers(),
+		//diagnostics
+		SlowDialThreshold: s.config.SlowDialThreshold,
+		StallThreshold:    s.config.StallThreshold,
+		CopyBufferSize:    s.config.CopyBufferSize,
+		DialFilter:        s.config.DialFilter,
+		NoDelay:           s.config.NoDelay,
+		ProfileLabels:     s.config.ProfileLabels,
+		ConnMiddleware:    s.config.ConnMiddleware,
+		DialMiddleware:    s.config.DialMiddleware,
 	})
+	//bind reversed-remotes before replying,
+	//so the client may retry failed binds
+	proxies, err := tunnel.ListenRemotes(c.Remotes.Reversed(true), c.AlternatePorts)
+	if err != nil {
+		failed(s.Errorf("%s: %s", settings.ReverseBindError, err))
+		return
+	}
+	ports, err := alternatePorts(user, proxies)
+	if err != nil {
+		for _, p := range proxies {
+			p.Close()
+		}
+		failed(s.Errorf("%s", err))
+		return
+	}
+	//successfuly validated config!
+	if c.RemoteIDs {
+		tunnel.SetRemoteIDs(true)
+		r.Reply(true, settings.EncodeConfigReply(settings.ConfigReply{
+			RemoteIDs: true,
+			Time:      time.Now().UnixNano(),
+			Ports:     ports,
+		}))
+	} else {
+		r.Reply(true, nil)
+	}
 	//bind
 	eg, ctx := errgroup.WithContext(req.Context())
+	sid := fmt.Sprintf("%x", sshConn.SessionID())
+	remotes := map[string]*settings.Remote{}
+	for _, r := range c.Remotes {
+		remotes[r.Encode()] = r
+	}
+	s.addSession(sid, &session{
+		ctx:      ctx,
+		sshConn:  sshConn,
+		tunnel:   tunnel,
+		clientID: c.ClientID,
+		reverse:  map[string]func(){},
+		remotes:  remotes,
+	})
+	defer s.removeSession(sid)
 	eg.Go(func() error {
 		//connected, handover ssh connection for tunnel to use, and block
 		return tunnel.BindSSH(ctx, sshConn, reqs, chans)
 	})
 	eg.Go(func() error {
-		//connected, setup reversed-remotes
-		serverInbound := c.Remotes.Reversed(true)
-		return tunnel.BindRemotes(ctx, serverInbound)
+		//connected, run reversed-remotes
+		return tunnel.RunProxies(ctx, proxies)
 	})
 	err = eg.Wait()
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
@@ -156,3 +241,55 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		l.Debugf("Closed connection")
 	}
 }
+
+//alternatePorts of the proxies, by encoded remote, which
+//the user must also have access to
+func alternatePorts(user *settings.User, proxies []*tunnel.Proxy) (map[string]string, error) {
+	var ports map[string]string
+	for _, p := range proxies {
+		r := *p.Remote()
+		if p.Port() == r.LocalPort {
+			continue
+		}
+		if ports == nil {
+			ports = map[string]string{}
+		}
+		ports[r.Encode()] = p.Port()
+		r.LocalPort = p.Port()
+		for _, addr := range r.UserAddrs() {
+			if user != nil && !user.HasAccess(addr) {
+				return nil, fmt.Errorf("access to '%s' denied", addr)
+			}
+		}
+	}
+	return ports, nil
+}
+
+//remoteTLS confines the tls files of a client's remote which the
+//server reads (a reverse remote's certificate, or a forward remote's
+//CA) to the TLSRemoteDir, and checks they load
+func (s *Server) remoteTLS(r *settings.Remote) error {
+	files := []string{r.TLSCA}
+	if r.Reverse {
+		files = []string{r.TLSCert, r.TLSKey}
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if s.config.TLSRemoteDir == "" {
+			return errors.New("tls files are disabled, see --tls-remote-dir")
+		}
+		if f != filepath.Base(f) || f == "." || f == ".." || strings.ContainsAny(f, `/\`) {
+			return fmt.Errorf("tls file '%s' must be a file name", f)
+		}
+		r.TLSDir = s.config.TLSRemoteDir
+	}
+	var err error
+	if r.Reverse {
+		_, err = r.ListenTLSConfig()
+	} else {
+		_, err = r.DialTLSConfig()
+	}
+	return err
+}
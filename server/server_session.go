@@ -0,0 +1,217 @@
+package chserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+//session is a connected client, which the
+//server may push remote changes to
+type session struct {
+	ctx     context.Context
+	sshConn ssh.Conn
+	tunnel  *tunnel.Tunnel
+	//clientID the client sent, if any
+	clientID string
+	//pushed reverse remotes by encoding
+	mut     sync.Mutex
+	reverse map[string]func()
+	//remotes of the client by encoding, for the MaxRemotes
+	remotes map[string]*settings.Remote
+}
+
+//checkLimits of the session's remotes, with r added
+func (s *Server) checkLimits(sess *session, r *settings.Remote) error {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	remotes := settings.Remotes{r}
+	for k, o := range sess.remotes {
+		if k != r.Encode() {
+			remotes = append(remotes, o)
+		}
+	}
+	return remotes.CheckLimits(s.config.MaxRemotes, s.config.MaxReverseRemotes)
+}
+
+func (sess *session) setRemote(r *settings.Remote, added bool) {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	if added {
+		sess.remotes[r.Encode()] = r
+	} else {
+		delete(sess.remotes, r.Encode())
+	}
+}
+
+//Sessions lists the IDs of the connected clients, these
+//match the SessionID each client reports in its AuthInfo
+func (s *Server) Sessions() []string {
+	s.activeMut.Lock()
+	defer s.activeMut.Unlock()
+	ids := make([]string, 0, len(s.active))
+	for id := range s.active {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+//AddClientRemote asks a connected client to add a remote, a
+//reverse remote is then bound by the server. The client must
+//have AllowServerRemotes set, and keeps the remote across
+//reconnects (though the session ID will change).
+func (s *Server) AddClientRemote(sessionID, spec string) error {
+	sess, r, err := s.clientRemote(sessionID, spec)
+	if err != nil {
+		return err
+	}
+	if r.Reverse && !s.config.Reverse {
+		return errors.New("Reverse port forwarding not enabled on server")
+	}
+	if err := s.checkLimits(sess, r); err != nil {
+		return err
+	}
+	//unlike a client's remotes, the spec is the server's
+	//own, so its tls files aren't confined to TLSRemoteDir
+	if !r.Reverse {
+		if _, err := r.DialTLSConfig(); err != nil {
+			return err
+		}
+		//register first, so the client's dials use its options
+		sess.tunnel.AddOutboundRemote(r)
+	}
+	if err := push(sess.sshConn, settings.RemoteAddRequest, r); err != nil {
+		if !r.Reverse {
+			sess.tunnel.RemoveOutboundRemote(r)
+		}
+		return err
+	}
+	if !r.Reverse {
+		sess.setRemote(r, true)
+		return nil
+	}
+	p, err := sess.tunnel.Listen(r)
+	if err != nil {
+		//undo on the client
+		push(sess.sshConn, settings.RemoteRemoveRequest, r)
+		return err
+	}
+	sess.setRemote(r, true)
+	ctx, cancel := context.WithCancel(sess.ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	sess.mut.Lock()
+	sess.reverse[r.Encode()] = func() {
+		cancel()
+		<-done
+	}
+	sess.mut.Unlock()
+	return nil
+}
+
+//RemoveClientRemote asks a connected client to remove a remote,
+//open connections are not interrupted
+func (s *Server) RemoveClientRemote(sessionID, spec string) error {
+	sess, r, err := s.clientRemote(sessionID, spec)
+	if err != nil {
+		return err
+	}
+	if err := push(sess.sshConn, settings.RemoteRemoveRequest, r); err != nil {
+		return err
+	}
+	sess.setRemote(r, false)
+	if !r.Reverse {
+		sess.tunnel.RemoveOutboundRemote(r)
+		return nil
+	}
+	//reverse remotes from the initial config
+	//stay bound until the client reconnects
+	sess.mut.Lock()
+	stop, ok := sess.reverse[r.Encode()]
+	delete(sess.reverse, r.Encode())
+	sess.mut.Unlock()
+	if ok {
+		stop()
+	}
+	return nil
+}
+
+func (s *Server) clientRemote(sessionID, spec string) (*session, *settings.Remote, error) {
+	s.activeMut.Lock()
+	sess, ok := s.active[sessionID]
+	s.activeMut.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("Session '%s' not found", sessionID)
+	}
+	r, err := settings.DecodeRemote(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode remote '%s': %s", spec, err)
+	}
+	return sess, r, nil
+}
+
+//SendRequest sends a custom SSH global request to a connected
+//client, waiting for its reply, see the client's RequestHandlers
+func (s *Server) SendRequest(sessionID, name string, payload []byte) (bool, []byte, error) {
+	s.activeMut.Lock()
+	sess, ok := s.active[sessionID]
+	s.activeMut.Unlock()
+	if !ok {
+		return false, nil, fmt.Errorf("Session '%s' not found", sessionID)
+	}
+	return sess.sshConn.SendRequest(name, true, payload)
+}
+
+//ClientID is the identity a connected client sent in its
+//config (see the client's ClientID), it's empty when the client
+//sent none, and isn't authenticated, so only suits display
+func (s *Server) ClientID(sessionID string) (string, error) {
+	s.activeMut.Lock()
+	sess, ok := s.active[sessionID]
+	s.activeMut.Unlock()
+	if !ok {
+		return "", fmt.Errorf("Session '%s' not found", sessionID)
+	}
+	return sess.clientID, nil
+}
+
+//requestHandlers of each session's tunnel
+func (s *Server) requestHandlers() map[string]func([]byte) (bool, []byte) {
+	handlers := map[string]func([]byte) (bool, []byte){}
+	for name, h := range s.config.RequestHandlers {
+		handlers[name] = h
+	}
+	return handlers
+}
+
+//push sends a remote change to the client and waits for its ack
+func push(sshConn ssh.Conn, req string, r *settings.Remote) error {
+	ok, reply, err := sshConn.SendRequest(req, true, []byte(r.Encode()))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Client rejected remote '%s': %s", r, reply)
+	}
+	return nil
+}
+
+func (s *Server) addSession(id string, sess *session) {
+	s.activeMut.Lock()
+	s.active[id] = sess
+	s.activeMut.Unlock()
+}
+
+func (s *Server) removeSession(id string) {
+	s.activeMut.Lock()
+	delete(s.active, id)
+	s.activeMut.Unlock()
+}
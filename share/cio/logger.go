@@ -13,6 +13,7 @@ type Logger struct {
 	prefix      string
 	logger      *log.Logger
 	info, debug *bool
+	ring        *Ring
 }
 
 func NewLogger(prefix string) *Logger {
@@ -31,13 +32,21 @@ func NewLoggerFlag(prefix string, flag int) *Logger {
 
 func (l *Logger) Infof(f string, args ...interface{}) {
 	if l.IsInfo() {
-		l.logger.Printf(l.prefix+": "+f, args...)
+		l.output(f, args)
 	}
 }
 
 func (l *Logger) Debugf(f string, args ...interface{}) {
 	if l.IsDebug() {
-		l.logger.Printf(l.prefix+": "+f, args...)
+		l.output(f, args)
+	}
+}
+
+func (l *Logger) output(f string, args []interface{}) {
+	msg := fmt.Sprintf(l.prefix+": "+f, args...)
+	l.logger.Print(msg)
+	if l.ring != nil {
+		l.ring.Add(msg)
 	}
 }
 
@@ -62,9 +71,16 @@ func (l *Logger) Fork(prefix string, args ...interface{}) *Logger {
 	} else {
 		ll.debug = &l.Debug
 	}
+	ll.ring = l.ring
 	return ll
 }
 
+//SetRing additionally records each printed line in the
+//given Ring, loggers forked afterwards share the Ring
+func (l *Logger) SetRing(r *Ring) {
+	l.ring = r
+}
+
 func (l *Logger) Prefix() string {
 	return l.prefix
 }
@@ -6,7 +6,42 @@ import (
 	"sync"
 )
 
+//Pipe copies data in both directions between src and dst. When one
+//side reaches EOF, the write half of the other side is shut down (when
+//supported), so half-closed protocols continue to work. Both sides are
+//closed once both directions are done, or as soon as either errors.
 func Pipe(src io.ReadWriteCloser, dst io.ReadWriteCloser) (int64, int64) {
+	return PipeWith(src, dst, PipeOptions{})
+}
+
+//DefaultBufferSize is the copy buffer size of Pipe (as in io.Copy)
+const DefaultBufferSize = 32 * 1024
+
+//PipeOptions optionally change how PipeWith copies
+type PipeOptions struct {
+	//BufferSize of each direction's copy buffer,
+	//defaults to DefaultBufferSize
+	BufferSize int
+	//Sent and Received are told of bytes as they are written,
+	//so counts stay accurate while a pipe is active or when
+	//it's cut short
+	Sent, Received func(n int64)
+}
+
+//PipeWith is Pipe, with the given options
+func PipeWith(src, dst io.ReadWriteCloser, opts PipeOptions) (int64, int64) {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	//an explicit buffer size bypasses any WriterTo,
+	//which would otherwise copy with its own buffer
+	from := func(r io.Reader) io.Reader {
+		if opts.BufferSize > 0 {
+			return readerOnly{r}
+		}
+		return r
+	}
 	var sent, received int64
 	var wg sync.WaitGroup
 	var o sync.Once
@@ -16,19 +51,62 @@ func Pipe(src io.ReadWriteCloser, dst io.ReadWriteCloser) (int64, int64) {
 	}
 	wg.Add(2)
 	go func() {
-		received, _ = io.Copy(src, dst)
-		o.Do(close)
+		var err error
+		received, err = io.CopyBuffer(countWriter(src, opts.Received), from(dst), make([]byte, size))
+		halfClose(src, err, func() { o.Do(close) })
 		wg.Done()
 	}()
 	go func() {
-		sent, _ = io.Copy(dst, src)
-		o.Do(close)
+		var err error
+		sent, err = io.CopyBuffer(countWriter(dst, opts.Sent), from(src), make([]byte, size))
+		halfClose(dst, err, func() { o.Do(close) })
 		wg.Done()
 	}()
 	wg.Wait()
+	o.Do(close)
 	return sent, received
 }
 
+type readerOnly struct {
+	io.Reader
+}
+
+//countWriter reports each write to count, if set
+func countWriter(w io.Writer, count func(n int64)) io.Writer {
+	if count == nil {
+		return w
+	}
+	return &counter{w, count}
+}
+
+type counter struct {
+	w     io.Writer
+	count func(n int64)
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.count(int64(n))
+	}
+	return n, err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+//halfClose propagates a clean EOF as a write shutdown on w,
+//anything else (or no CloseWrite support) closes both sides
+func halfClose(w io.Writer, err error, close func()) {
+	if cw, ok := w.(closeWriter); ok && err == nil {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+	close()
+}
+
 const vis = false
 
 type pipeVisPrinter struct {
@@ -0,0 +1,106 @@
+package cio
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeHalfClose(t *testing.T) {
+	//client <-> a ==pipe== b <-> server
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	type result struct{ sent, received int64 }
+	done := make(chan result)
+	go func() {
+		s, r := Pipe(a, b)
+		done <- result{s, r}
+	}()
+	//client sends, then closes its write half only
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	//server sees EOF after the request...
+	req, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req) != "hello" {
+		t.Fatalf("expected hello, got %q", req)
+	}
+	//...and can still respond through the pipe
+	if _, err := server.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	resp, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "world" {
+		t.Fatalf("expected world, got %q", resp)
+	}
+	client.Close()
+	if r := <-done; r.sent != 5 || r.received != 5 {
+		t.Fatalf("expected 5/5 bytes, got %d/%d", r.sent, r.received)
+	}
+}
+
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+//slowLink delays each write by a round trip, like a sender
+//waiting for each buffer to be acknowledged
+type slowLink struct {
+	net.Conn
+	rtt time.Duration
+}
+
+func (s slowLink) Write(p []byte) (int, error) {
+	time.Sleep(s.rtt)
+	return s.Conn.Write(p)
+}
+
+//BenchmarkPipeBufferSize shows the throughput of each buffer
+//size over a link with a 1ms round trip, where throughput is
+//bounded by the buffer size per round trip
+func BenchmarkPipeBufferSize(b *testing.B) {
+	const total = 4 << 20
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				client, a := tcpPair(b)
+				c, server := tcpPair(b)
+				go PipeWith(a, slowLink{c, time.Millisecond}, PipeOptions{BufferSize: size})
+				go func() {
+					client.Write(make([]byte, total))
+					client.Close()
+				}()
+				io.Copy(ioutil.Discard, server)
+				server.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package cio
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//Ring is a fixed-size, concurrency-safe
+//buffer of the most recent log lines
+type Ring struct {
+	mut   sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+//NewRing creates a Ring holding up to size lines
+func NewRing(size int) *Ring {
+	return &Ring{lines: make([]string, size)}
+}
+
+//Add a line, overwriting the oldest once full
+func (r *Ring) Add(line string) {
+	if len(r.lines) == 0 {
+		return
+	}
+	line = time.Now().Format("2006/01/02 15:04:05 ") + strings.TrimSuffix(line, "\n")
+	r.mut.Lock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mut.Unlock()
+}
+
+//Last returns up to n of the most recent lines, oldest first
+func (r *Ring) Last(n int) []string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	if n < 0 || n > count {
+		n = count
+	}
+	out := make([]string, n)
+	for i := 0; i < n; i++ {
+		j := (r.next - n + i + len(r.lines)) % len(r.lines)
+		out[i] = r.lines[j]
+	}
+	return out
+}
@@ -0,0 +1,28 @@
+package cio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	if got := r.Last(10); len(got) != 0 {
+		t.Fatalf("expected empty ring, got %v", got)
+	}
+	for _, l := range []string{"a", "b", "c", "d"} {
+		r.Add(l)
+	}
+	got := r.Last(10)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 lines, got %v", got)
+	}
+	for i, expect := range []string{"b", "c", "d"} {
+		if !strings.HasSuffix(got[i], " "+expect) {
+			t.Fatalf("line #%d expected %s, got %s", i+1, expect, got[i])
+		}
+	}
+	if got := r.Last(1); len(got) != 1 || !strings.HasSuffix(got[0], " d") {
+		t.Fatalf("expected most recent line, got %v", got)
+	}
+}
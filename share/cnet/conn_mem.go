@@ -0,0 +1,151 @@
+package cnet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//MemPipe is an in-memory, full duplex net.Conn pair, what's written
+//to one is read from the other. Unlike net.Pipe, writes are buffered
+//and don't wait for a reader, as protocols which write before they
+//read (like the SSH handshake) need. Deadlines are supported.
+func MemPipe() (net.Conn, net.Conn) {
+	a := newMemBuffer()
+	b := newMemBuffer()
+	return &memConn{r: a, w: b, local: memAddr("a"), remote: memAddr("b")},
+		&memConn{r: b, w: a, local: memAddr("b"), remote: memAddr("a")}
+}
+
+//memBuffer is one direction of a MemPipe
+type memBuffer struct {
+	mut      sync.Mutex
+	cond     *sync.Cond
+	buff     []byte
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemBuffer() *memBuffer {
+	m := &memBuffer{}
+	m.cond = sync.NewCond(&m.mut)
+	return m
+}
+
+func (m *memBuffer) read(b []byte) (int, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for len(m.buff) == 0 {
+		if m.closed {
+			return 0, io.EOF
+		}
+		if !m.deadline.IsZero() && !time.Now().Before(m.deadline) {
+			return 0, memTimeout{}
+		}
+		m.cond.Wait()
+	}
+	n := copy(b, m.buff)
+	m.buff = m.buff[n:]
+	return n, nil
+}
+
+func (m *memBuffer) write(b []byte) (int, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return 0, io.ErrClosedPipe
+	}
+	m.buff = append(m.buff, b...)
+	m.cond.Broadcast()
+	return len(b), nil
+}
+
+func (m *memBuffer) close() {
+	m.mut.Lock()
+	m.closed = true
+	m.cond.Broadcast()
+	m.mut.Unlock()
+}
+
+//setDeadline wakes blocked reads once t passes
+func (m *memBuffer) setDeadline(t time.Time) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.deadline = t
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if !t.IsZero() {
+		m.timer = time.AfterFunc(time.Until(t), func() {
+			m.mut.Lock()
+			m.cond.Broadcast()
+			m.mut.Unlock()
+		})
+	}
+	m.cond.Broadcast()
+}
+
+type memConn struct {
+	r, w          *memBuffer
+	local, remote memAddr
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.w.write(b)
+}
+
+//Close both directions, the peer reads
+//what was buffered, and then io.EOF
+func (c *memConn) Close() error {
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+//SetWriteDeadline is a no-op, writes don't block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//memAddr is the address of each end of a MemPipe
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return "mem:" + string(a)
+}
+
+//memTimeout is returned by reads past the deadline
+type memTimeout struct{}
+
+func (memTimeout) Error() string   { return "i/o timeout" }
+func (memTimeout) Timeout() bool   { return true }
+func (memTimeout) Temporary() bool { return true }
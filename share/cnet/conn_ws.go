@@ -1,25 +1,94 @@
 package cnet
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+//ErrPingTimeout is returned by reads once a ping of a
+//NewPingingWebSocketConn goes unanswered
+var ErrPingTimeout = errors.New("websocket ping timeout")
+
 type wsConn struct {
 	*websocket.Conn
-	buff []byte
+	buff     []byte
+	once     sync.Once
+	done     chan struct{}
+	timedOut int32
 }
 
 //NewWebSocketConn converts a websocket.Conn into a net.Conn
 func NewWebSocketConn(websocketConn *websocket.Conn) net.Conn {
 	c := wsConn{
 		Conn: websocketConn,
+		done: make(chan struct{}),
 	}
 	return &c
 }
 
+//NewPingingWebSocketConn is NewWebSocketConn, which also sends a
+//ping frame every interval, and closes the conn when its pong isn't
+//received within the timeout (defaults to the interval). Pongs are
+//received while reading, peers reply to pings automatically.
+func NewPingingWebSocketConn(websocketConn *websocket.Conn, interval, timeout time.Duration) net.Conn {
+	c := NewWebSocketConn(websocketConn).(*wsConn)
+	if timeout <= 0 {
+		timeout = interval
+	}
+	pongs := make(chan struct{}, 1)
+	c.Conn.SetPongHandler(func(string) error {
+		select {
+		case pongs <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go c.pingLoop(interval, timeout, pongs)
+	return c
+}
+
+func (c *wsConn) pingLoop(interval, timeout time.Duration, pongs chan struct{}) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-c.done:
+			return
+		}
+		//drop any late pong
+		select {
+		case <-pongs:
+		default:
+		}
+		if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+			c.timeout()
+			return
+		}
+		select {
+		case <-pongs:
+		case <-time.After(timeout):
+			c.timeout()
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) timeout() {
+	atomic.StoreInt32(&c.timedOut, 1)
+	c.Close()
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
 //Read is not threadsafe though thats okay since there
 //should never be more than one reader
 func (c *wsConn) Read(dst []byte) (int, error) {
@@ -31,6 +100,8 @@ func (c *wsConn) Read(dst []byte) (int, error) {
 		c.buff = nil
 	} else if _, msg, err := c.Conn.ReadMessage(); err == nil {
 		src = msg
+	} else if atomic.LoadInt32(&c.timedOut) == 1 {
+		return 0, ErrPingTimeout
 	} else {
 		return 0, err
 	}
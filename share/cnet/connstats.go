@@ -23,6 +23,11 @@ func (c *ConnCount) Close() {
 	atomic.AddInt32(&c.open, -1)
 }
 
+//Counts are the open connections, and all of them so far
+func (c *ConnCount) Counts() (open, total int32) {
+	return atomic.LoadInt32(&c.open), atomic.LoadInt32(&c.count)
+}
+
 func (c *ConnCount) String() string {
 	return fmt.Sprintf("[%d/%d]", atomic.LoadInt32(&c.open), atomic.LoadInt32(&c.count))
 }
@@ -8,6 +8,15 @@ import (
 type Config struct {
 	Version string
 	Remotes
+	//RemoteIDs is set by clients which identify the remote of
+	//each channel they open, and accept a ConfigReply
+	RemoteIDs bool `json:",omitempty"`
+	//AlternatePorts asks the server to bind reverse remotes whose
+	//port is in use to a free port, reported in the ConfigReply
+	AlternatePorts bool `json:",omitempty"`
+	//ClientID identifies the client to the server's operators
+	//(e.g. its hostname), it's not authenticated
+	ClientID string `json:",omitempty"`
 }
 
 func DecodeConfig(b []byte) (*Config, error) {
@@ -24,3 +33,46 @@ func EncodeConfig(c Config) []byte {
 	b, _ := json.Marshal(c)
 	return b
 }
+
+//ConfigReply is the server's reply to a config which set RemoteIDs,
+//older clients treat any reply as an error so aren't sent one
+type ConfigReply struct {
+	RemoteIDs bool `json:",omitempty"`
+	//Time is the server's wall clock time when it replied, in
+	//unix nanoseconds, used to estimate the client's clock skew
+	Time int64 `json:",omitempty"`
+	//Ports are those bound on alternate ports, by encoded remote
+	Ports map[string]string `json:",omitempty"`
+}
+
+func DecodeConfigReply(b []byte) (*ConfigReply, error) {
+	c := &ConfigReply{}
+	//older servers reply without a payload
+	if len(b) == 0 {
+		return c, nil
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Invalid JSON config reply")
+	}
+	return c, nil
+}
+
+func EncodeConfigReply(c ConfigReply) []byte {
+	b, _ := json.Marshal(c)
+	return b
+}
+
+//SSH global requests which the server sends to push remote
+//changes to a connected client, the payload is an encoded remote
+const (
+	RemoteAddRequest    = "chisel-remote-add"
+	RemoteRemoveRequest = "chisel-remote-remove"
+)
+
+//ReverseBindError is reported in the config reply when
+//the server fails to bind one of the reverse remotes
+const ReverseBindError = "failed to bind reverse remote"
+
+//RedirectPrefix is followed by a server URL in the config
+//reply, when the server redirects the client to another node
+const RedirectPrefix = "redirect to "
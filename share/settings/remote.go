@@ -2,10 +2,12 @@ package settings
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // short-hand conversions (see remote_test)
@@ -30,26 +32,269 @@ import (
 //   1.1.1.1:53/udp
 //     local  127.0.0.1:53/udp
 //     remote 1.1.1.1:53/udp
+//   1.1.1.1:53/tcp+udp
+//     local  127.0.0.1:53/tcp and 127.0.0.1:53/udp
+//     remote 1.1.1.1:53/tcp and 1.1.1.1:53/udp
+//   timeout=5s:3000:google.com:80
+//     local  127.0.0.1:3000
+//     remote google.com:80 (dial timeout 5s)
+//   schedule=2200-0600:tz=UTC:3000
+//     local  127.0.0.1:3000 (only bound from 22:00 to 06:00 UTC)
+//     remote 127.0.0.1:3000
+//   tls-cert=/etc/cert.pem:tls-key=/etc/key.pem:3000:example.com:80
+//     local  127.0.0.1:3000 (terminates TLS)
+//     remote example.com:80
+//   tls-ca=/etc/ca.pem:3000:example.com:443
+//     local  127.0.0.1:3000
+//     remote example.com:443 (originates TLS)
+//   R:proxy-protocol=true:8080:localhost:80
+//     local  0.0.0.0:8080 (on the server)
+//     remote localhost:80 (receives the PROXY protocol)
+//   weight=3:3000:localhost:80
+//     local  127.0.0.1:3000 (3x the bandwidth share)
+//     remote localhost:80
+//   conn-rate=10:3000:localhost:80
+//     local  127.0.0.1:3000 (accepts 10 connections per second)
+//     remote localhost:80
+//   nodelay=false:3000:localhost:80
+//     local  127.0.0.1:3000 (Nagle's algorithm enabled)
+//     remote localhost:80 (Nagle's algorithm enabled)
+//   max-lifetime=1h:3000:localhost:80
+//     local  127.0.0.1:3000 (connections are closed after an hour)
+//     remote localhost:80
+//   127.0.0.1,192.168.0.1:3000:localhost:80
+//     local  127.0.0.1:3000 and 192.168.0.1:3000
+//     remote localhost:80
+//   name=db:5432:db.internal:5432
+//     local  127.0.0.1:5432 (its stats are labelled db)
+//     remote db.internal:5432
+//   3000:web1*3,web2:80
+//     local  127.0.0.1:3000
+//     remote web1:80 and web2:80 (3 connections to web1 per 1 to web2)
+//   balance=random:3000:web1,web2:80
+//     local  127.0.0.1:3000
+//     remote web1:80 or web2:80 (picked at random)
+//   fallback-direct=true:3000:intranet:80
+//     local  127.0.0.1:3000
+//     remote intranet:80 (dialed directly while the tunnel is down)
+//   dial-retries=3:dial-backoff=200ms:3000:localhost:80
+//     local  127.0.0.1:3000
+//     remote localhost:80 (dialed up to 4 times, 200ms, 400ms then 800ms apart)
 
 type Remote struct {
 	LocalHost, LocalPort, LocalProto    string
 	RemoteHost, RemotePort, RemoteProto string
 	Socks, Reverse, Stdio               bool
+	//options
+	DialTimeout time.Duration `json:",omitempty"`
+	Schedule    string        `json:",omitempty"`
+	ScheduleTZ  string        `json:",omitempty"`
+	TLSCert     string        `json:",omitempty"`
+	TLSKey      string        `json:",omitempty"`
+	TLSCA       string        `json:",omitempty"`
+	TLSOrigin   bool          `json:",omitempty"`
+	//TLSDir, when set, is the directory the tls files are
+	//named within, it's local to each side so isn't encoded
+	TLSDir string `json:"-"`
+	//ProxyProtocol prefixes each connection with a
+	//PROXY protocol v1 header, carrying its source address
+	ProxyProtocol bool `json:",omitempty"`
+	//Weight is this remote's share of a bandwidth
+	//limit, relative to other remotes (default 1)
+	Weight int `json:",omitempty"`
+	//ConnRate limits the new connections per
+	//second accepted by this remote's listener
+	ConnRate float64 `json:",omitempty"`
+	//NoDelay sets TCP_NODELAY on this remote's tcp connections,
+	//nil keeps the tunnel's setting (see tunnel.Config.NoDelay)
+	NoDelay *bool `json:",omitempty"`
+	//MaxConnLifetime closes this remote's connections once
+	//they've been open for this long, regardless of activity
+	MaxConnLifetime time.Duration `json:",omitempty"`
+	//Name is a stable label of this remote's stats
+	//(see tunnel.LabelByName), instead of its spec
+	Name string `json:",omitempty"`
+	//Balance picks the target of each connection to a pool
+	//of remote hosts, BalanceRoundRobin (the default) or
+	//BalanceRandom, both honour the targets' weights
+	Balance string `json:",omitempty"`
+	//FallbackDirect dials the remote directly, bypassing the
+	//tunnel, for connections accepted while it's down
+	FallbackDirect bool `json:",omitempty"`
+	//DialRetries is the number of times a failed dial of
+	//the remote's target is retried, before giving up on
+	//the connection, waiting DialBackoff (default 100ms,
+	//doubling after each retry, up to 10s) between attempts
+	DialRetries int           `json:",omitempty"`
+	DialBackoff time.Duration `json:",omitempty"`
+	//schedule is the parsed Schedule and ScheduleTZ
+	schedule *schedule
 }
 
 const revPrefix = "R:"
 
+//ProtoTCPUDP remotes forward both tcp and udp, with
+//a listener of each protocol bound on the same port
+const ProtoTCPUDP = "tcp+udp"
+
+//Balance strategies of a pool of remote hosts
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceRandom     = "random"
+)
+
+//remoteOptions are the <key>=<value> annotations
+//which may prefix a remote
+var remoteName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var remoteOptions = map[string]func(r *Remote, v string) error{
+	"name": func(r *Remote, v string) error {
+		if !remoteName.MatchString(v) {
+			return errors.New("Invalid name, expected letters, digits, '.', '_' or '-'")
+		}
+		r.Name = v
+		return nil
+	},
+	"balance": func(r *Remote, v string) error {
+		if v != BalanceRoundRobin && v != BalanceRandom {
+			return fmt.Errorf("Invalid balance, expected %s or %s", BalanceRoundRobin, BalanceRandom)
+		}
+		r.Balance = v
+		return nil
+	},
+	"timeout": func(r *Remote, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return errors.New("Invalid timeout")
+		}
+		r.DialTimeout = d
+		return nil
+	},
+	"dial-retries": func(r *Remote, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("Invalid dial-retries")
+		}
+		r.DialRetries = n
+		return nil
+	},
+	"dial-backoff": func(r *Remote, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return errors.New("Invalid dial-backoff")
+		}
+		r.DialBackoff = d
+		return nil
+	},
+	"schedule": func(r *Remote, v string) error {
+		if _, _, err := parseWindow(v); err != nil {
+			return err
+		}
+		r.Schedule = v
+		return nil
+	},
+	"tz": func(r *Remote, v string) error {
+		if _, err := time.LoadLocation(v); err != nil {
+			return fmt.Errorf("Invalid tz (%s)", err)
+		}
+		r.ScheduleTZ = v
+		return nil
+	},
+	"tls-cert": func(r *Remote, v string) error {
+		r.TLSCert = v
+		return nil
+	},
+	"tls-key": func(r *Remote, v string) error {
+		r.TLSKey = v
+		return nil
+	},
+	"tls-ca": func(r *Remote, v string) error {
+		r.TLSCA = v
+		r.TLSOrigin = true
+		return nil
+	},
+	"proxy-protocol": func(r *Remote, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid proxy-protocol")
+		}
+		r.ProxyProtocol = b
+		return nil
+	},
+	"weight": func(r *Remote, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return errors.New("Invalid weight")
+		}
+		r.Weight = n
+		return nil
+	},
+	"conn-rate": func(r *Remote, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return errors.New("Invalid conn-rate")
+		}
+		r.ConnRate = f
+		return nil
+	},
+	"max-lifetime": func(r *Remote, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return errors.New("Invalid max-lifetime")
+		}
+		r.MaxConnLifetime = d
+		return nil
+	},
+	"nodelay": func(r *Remote, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid nodelay")
+		}
+		r.NoDelay = &b
+		return nil
+	},
+	"fallback-direct": func(r *Remote, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid fallback-direct")
+		}
+		r.FallbackDirect = b
+		return nil
+	},
+	"tls-origin": func(r *Remote, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid tls-origin")
+		}
+		r.TLSOrigin = b
+		return nil
+	},
+}
+
 func DecodeRemote(s string) (*Remote, error) {
-	reverse := false
-	if strings.HasPrefix(s, revPrefix) {
-		s = strings.TrimPrefix(s, revPrefix)
-		reverse = true
-	}
+	r := &Remote{}
 	parts := strings.Split(s, ":")
+	//strip reverse prefix and options
+	for len(parts) > 1 {
+		p := parts[0]
+		if p+":" == revPrefix && !r.Reverse {
+			r.Reverse = true
+		} else if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			set, ok := remoteOptions[kv[0]]
+			if !ok {
+				return nil, fmt.Errorf("Unknown option '%s'", kv[0])
+			}
+			if err := set(r, kv[1]); err != nil {
+				return nil, err
+			}
+		} else {
+			break
+		}
+		parts = parts[1:]
+	}
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("Invalid remote")
 	}
-	r := &Remote{Reverse: reverse}
 	//parse from back to front, to set 'remote' fields first,
 	//then to set 'local' fields second (allows the 'remote' side
 	//to provide the defaults)
@@ -128,9 +373,205 @@ func DecodeRemote(s string) (*Remote, error) {
 	if r.Stdio && r.Reverse {
 		return nil, errors.New("stdio cannot be reversed")
 	}
+	if r.Stdio && r.RemoteProto == ProtoTCPUDP {
+		return nil, errors.New("stdio cannot be tcp+udp")
+	}
+	if r.ScheduleTZ != "" && r.Schedule == "" {
+		return nil, errors.New("tz requires a schedule")
+	}
+	if r.Schedule != "" {
+		s, err := parseSchedule(r.Schedule, r.ScheduleTZ)
+		if err != nil {
+			return nil, err
+		}
+		r.schedule = s
+	}
+	if (r.TLSCert == "") != (r.TLSKey == "") {
+		return nil, errors.New("tls-cert and tls-key must be set together")
+	}
+	if r.TLSCA != "" && !r.TLSOrigin {
+		return nil, errors.New("tls-ca requires tls-origin")
+	}
+	if (r.TLSCert != "" || r.TLSOrigin) && (r.Socks || r.Stdio || r.RemoteProto != "tcp") {
+		return nil, errors.New("TLS is only supported on tcp remotes")
+	}
+	if r.ProxyProtocol && (r.Socks || r.Stdio || r.RemoteProto != "tcp") {
+		return nil, errors.New("proxy-protocol is only supported on tcp remotes")
+	}
+	if r.ConnRate > 0 && (r.Stdio || r.LocalProto != "tcp") {
+		return nil, errors.New("conn-rate is only supported on tcp listeners")
+	}
+	if r.MaxConnLifetime > 0 && (r.Stdio || r.LocalProto != "tcp") {
+		return nil, errors.New("max-lifetime is only supported on tcp listeners")
+	}
+	if r.NoDelay != nil && r.RemoteProto != "tcp" {
+		return nil, errors.New("nodelay is only supported on tcp remotes")
+	}
+	if r.FallbackDirect && (r.Reverse || r.Socks || r.RemoteProto != "tcp") {
+		return nil, errors.New("fallback-direct is only supported on forward tcp remotes")
+	}
+	if (r.DialRetries > 0 || r.DialBackoff > 0) && r.RemoteProto != "tcp" {
+		return nil, errors.New("dial-retries is only supported on tcp remotes")
+	}
+	if r.DialBackoff > 0 && r.DialRetries == 0 {
+		return nil, errors.New("dial-backoff requires dial-retries")
+	}
+	if pool := strings.ContainsAny(r.RemoteHost, ",*"); pool || r.Balance != "" {
+		if !pool {
+			return nil, errors.New("balance requires a pool of remote hosts")
+		}
+		if r.Socks || r.RemoteProto != "tcp" {
+			return nil, errors.New("pools of remote hosts are only supported on tcp remotes")
+		}
+		if _, err := parseTargets(r.RemoteHost, r.RemotePort); err != nil {
+			return nil, err
+		}
+	}
+	if hosts := r.LocalHosts(); len(hosts) > 1 {
+		if r.LocalProto != "tcp" {
+			return nil, errors.New("multiple local hosts are only supported on tcp listeners")
+		}
+		for _, h := range hosts {
+			if h == "" {
+				return nil, errors.New("Invalid host")
+			}
+		}
+	}
 	return r, nil
 }
 
+//LocalHosts are the comma separated hosts of the local side,
+//a listener is bound for each
+func (r Remote) LocalHosts() []string {
+	if r.LocalHost == "" {
+		return []string{"0.0.0.0"}
+	}
+	return strings.Split(r.LocalHost, ",")
+}
+
+//Locals are the addresses of each local listener
+func (r Remote) Locals() []string {
+	if r.Stdio {
+		return []string{"stdio"}
+	}
+	addrs := []string{}
+	for _, h := range r.LocalHosts() {
+		addrs = append(addrs, h+":"+r.LocalPort)
+	}
+	return addrs
+}
+
+//Target is a host of a remote's pool, with its weight
+type Target struct {
+	Addr   string
+	Weight int
+}
+
+//Targets are the comma separated remote hosts of a pool, with
+//the remote port, each optionally weighted with a *<weight> suffix
+func (r Remote) Targets() []Target {
+	t, err := parseTargets(r.Remote(), "")
+	if err != nil {
+		//not from DecodeRemote
+		return []Target{{Addr: r.Remote(), Weight: 1}}
+	}
+	return t
+}
+
+//parseTargets of hosts, which include the port when it's empty
+func parseTargets(hosts, port string) ([]Target, error) {
+	if port == "" {
+		i := strings.LastIndex(hosts, ":")
+		if i < 0 {
+			return nil, errors.New("Missing port")
+		}
+		hosts, port = hosts[:i], hosts[i+1:]
+	}
+	targets := []Target{}
+	for _, h := range strings.Split(hosts, ",") {
+		t := Target{Weight: 1}
+		if i := strings.Index(h, "*"); i >= 0 {
+			n, err := strconv.Atoi(h[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Invalid weight of remote host '%s'", h)
+			}
+			h, t.Weight = h[:i], n
+		}
+		if h == "" {
+			return nil, errors.New("Invalid host")
+		}
+		t.Addr = h + ":" + port
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+//parseWindow parses a daily HHMM-HHMM window into
+//minutes past midnight, the window may wrap past midnight
+func parseWindow(s string) (start, end int, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid schedule, expected HHMM-HHMM")
+	}
+	mins := make([]int, 2)
+	for i, p := range parts {
+		t, err := time.Parse("1504", p)
+		if err != nil {
+			return 0, 0, errors.New("Invalid schedule, expected HHMM-HHMM")
+		}
+		mins[i] = t.Hour()*60 + t.Minute()
+	}
+	if mins[0] == mins[1] {
+		return 0, 0, errors.New("Invalid schedule, window is empty")
+	}
+	return mins[0], mins[1], nil
+}
+
+//schedule is a daily window, in minutes past
+//midnight, in its time zone (nil is local)
+type schedule struct {
+	start, end int
+	loc        *time.Location
+}
+
+func parseSchedule(window, tz string) (*schedule, error) {
+	start, end, err := parseWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	s := &schedule{start: start, end: end}
+	if tz != "" {
+		if s.loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("Invalid tz (%s)", err)
+		}
+	}
+	return s, nil
+}
+
+//InSchedule reports whether the remote should be bound at the
+//given time, remotes without a schedule are always in schedule
+func (r Remote) InSchedule(t time.Time) bool {
+	if r.Schedule == "" {
+		return true
+	}
+	s := r.schedule
+	if s == nil {
+		//not from DecodeRemote
+		var err error
+		if s, err = parseSchedule(r.Schedule, r.ScheduleTZ); err != nil {
+			return false
+		}
+	}
+	if s.loc != nil {
+		t = t.In(s.loc)
+	}
+	m := t.Hour()*60 + t.Minute()
+	if s.start < s.end {
+		return m >= s.start && m < s.end
+	}
+	return m >= s.start || m < s.end
+}
+
 func isPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -150,13 +591,12 @@ func isHost(s string) bool {
 	return true
 }
 
-var l4Proto = regexp.MustCompile(`(?i)\/(tcp|udp)$`)
+var l4Proto = regexp.MustCompile(`(?i)\/(tcp\+udp|tcp|udp)$`)
 
 //L4Proto extacts the layer-4 protocol from the given string
 func L4Proto(s string) (head, proto string) {
-	if l4Proto.MatchString(s) {
-		l := len(s)
-		return strings.ToLower(s[:l-4]), s[l-3:]
+	if m := l4Proto.FindStringSubmatchIndex(s); m != nil {
+		return strings.ToLower(s[:m[0]]), strings.ToLower(s[m[2]:m[3]])
 	}
 	return s, ""
 }
@@ -170,8 +610,8 @@ func (r Remote) String() string {
 	sb.WriteString(strings.TrimPrefix(r.Local(), "0.0.0.0:"))
 	sb.WriteString("=>")
 	sb.WriteString(strings.TrimPrefix(r.Remote(), "127.0.0.1:"))
-	if r.RemoteProto == "udp" {
-		sb.WriteString("/udp")
+	if r.RemoteProto == "udp" || r.RemoteProto == ProtoTCPUDP {
+		sb.WriteString("/" + r.RemoteProto)
 	}
 	return sb.String()
 }
@@ -183,13 +623,66 @@ func (r Remote) Encode() string {
 	}
 	local := r.Local()
 	remote := r.Remote()
-	if r.RemoteProto == "udp" {
-		remote += "/udp"
+	if r.RemoteProto == "udp" || r.RemoteProto == ProtoTCPUDP {
+		remote += "/" + r.RemoteProto
 	}
 	if r.Reverse {
-		return "R:" + local + ":" + remote
+		return "R:" + r.encodeOptions() + local + ":" + remote
+	}
+	return r.encodeOptions() + local + ":" + remote
+}
+
+//encodeOptions back into their <key>=<value>: prefixes
+func (r Remote) encodeOptions() string {
+	sb := strings.Builder{}
+	if r.Name != "" {
+		sb.WriteString("name=" + r.Name + ":")
+	}
+	if r.Balance != "" {
+		sb.WriteString("balance=" + r.Balance + ":")
+	}
+	if r.DialTimeout > 0 {
+		sb.WriteString("timeout=" + r.DialTimeout.String() + ":")
+	}
+	if r.DialRetries > 0 {
+		sb.WriteString("dial-retries=" + strconv.Itoa(r.DialRetries) + ":")
+	}
+	if r.DialBackoff > 0 {
+		sb.WriteString("dial-backoff=" + r.DialBackoff.String() + ":")
+	}
+	if r.Schedule != "" {
+		sb.WriteString("schedule=" + r.Schedule + ":")
+	}
+	if r.ScheduleTZ != "" {
+		sb.WriteString("tz=" + r.ScheduleTZ + ":")
+	}
+	if r.TLSCert != "" {
+		sb.WriteString("tls-cert=" + r.TLSCert + ":tls-key=" + r.TLSKey + ":")
 	}
-	return local + ":" + remote
+	if r.TLSCA != "" {
+		sb.WriteString("tls-ca=" + r.TLSCA + ":")
+	} else if r.TLSOrigin {
+		sb.WriteString("tls-origin=true:")
+	}
+	if r.ProxyProtocol {
+		sb.WriteString("proxy-protocol=true:")
+	}
+	if r.Weight > 0 {
+		sb.WriteString("weight=" + strconv.Itoa(r.Weight) + ":")
+	}
+	if r.ConnRate > 0 {
+		sb.WriteString("conn-rate=" + strconv.FormatFloat(r.ConnRate, 'g', -1, 64) + ":")
+	}
+	if r.NoDelay != nil {
+		sb.WriteString("nodelay=" + strconv.FormatBool(*r.NoDelay) + ":")
+	}
+	if r.MaxConnLifetime > 0 {
+		sb.WriteString("max-lifetime=" + r.MaxConnLifetime.String() + ":")
+	}
+	if r.FallbackDirect {
+		sb.WriteString("fallback-direct=true:")
+	}
+	return sb.String()
 }
 
 //Local is the decodable local portion
@@ -223,6 +716,70 @@ func (r Remote) UserAddr() string {
 	return r.RemoteHost + ":" + r.RemotePort
 }
 
+//UserAddrs is UserAddr for each of the local hosts of a
+//reverse remote, or each target of a forward remote's pool,
+//which must all be allowed
+func (r Remote) UserAddrs() []string {
+	if !r.Reverse {
+		if !strings.ContainsAny(r.RemoteHost, ",*") {
+			return []string{r.UserAddr()}
+		}
+		addrs := []string{}
+		for _, t := range r.Targets() {
+			addrs = append(addrs, t.Addr)
+		}
+		return addrs
+	}
+	addrs := []string{}
+	for _, h := range r.LocalHosts() {
+		addrs = append(addrs, "R:"+h+":"+r.LocalPort)
+	}
+	return addrs
+}
+
+//Collides reports whether both remotes would listen on the
+//same socket on the same side of the tunnel
+func (r Remote) Collides(other Remote) bool {
+	if r.Stdio || other.Stdio {
+		return false
+	}
+	if r.Reverse != other.Reverse || !r.sharesProto(other) || r.LocalPort != other.LocalPort {
+		return false
+	}
+	for _, a := range r.LocalHosts() {
+		for _, b := range other.LocalHosts() {
+			if a == b || isAnyHost(a) || isAnyHost(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//SharesPort reports whether a forward and a reverse remote listen
+//on the same port, these collide when client and server share a host
+func (r Remote) SharesPort(other Remote) bool {
+	if r.Stdio || other.Stdio {
+		return false
+	}
+	return r.Reverse != other.Reverse && r.sharesProto(other) && r.LocalPort == other.LocalPort
+}
+
+//HasProto reports whether the remote listens with the given
+//protocol, tcp+udp remotes have both protocols
+func (r Remote) HasProto(proto string) bool {
+	return r.LocalProto == proto || r.LocalProto == ProtoTCPUDP && (proto == "tcp" || proto == "udp")
+}
+
+//sharesProto reports whether both remotes listen with a protocol in common
+func (r Remote) sharesProto(other Remote) bool {
+	return r.HasProto("tcp") && other.HasProto("tcp") || r.HasProto("udp") && other.HasProto("udp")
+}
+
+func isAnyHost(h string) bool {
+	return h == "" || h == "0.0.0.0" || h == "::" || h == "[::]"
+}
+
 type Remotes []*Remote
 
 //Filter out forward reversed/non-reversed remotes
@@ -237,6 +794,18 @@ func (rs Remotes) Reversed(reverse bool) Remotes {
 	return subset
 }
 
+//CheckLimits returns an error when there are more than max
+//remotes, or maxReverse reverse remotes (zero is unlimited)
+func (rs Remotes) CheckLimits(max, maxReverse int) error {
+	if max > 0 && len(rs) > max {
+		return fmt.Errorf("Too many remotes (%d, the limit is %d)", len(rs), max)
+	}
+	if n := len(rs.Reversed(true)); maxReverse > 0 && n > maxReverse {
+		return fmt.Errorf("Too many reverse remotes (%d, the limit is %d)", n, maxReverse)
+	}
+	return nil
+}
+
 //Encode back into strings
 func (rs Remotes) Encode() []string {
 	s := make([]string, len(rs))
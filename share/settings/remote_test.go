@@ -3,6 +3,7 @@ package settings
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestRemoteDecode(t *testing.T) {
@@ -81,6 +82,146 @@ func TestRemoteDecode(t *testing.T) {
 			},
 			"localhost:5353:1.1.1.1:53/udp",
 		},
+		{
+			"1.1.1.1:53/TCP+UDP",
+			Remote{
+				LocalPort:   "53",
+				LocalProto:  "tcp+udp",
+				RemoteHost:  "1.1.1.1",
+				RemotePort:  "53",
+				RemoteProto: "tcp+udp",
+			},
+			"0.0.0.0:53:1.1.1.1:53/tcp+udp",
+		},
+		{
+			"R:timeout=5s:2222:localhost:22",
+			Remote{
+				LocalPort:   "2222",
+				RemoteHost:  "localhost",
+				RemotePort:  "22",
+				Reverse:     true,
+				DialTimeout: 5 * time.Second,
+			},
+			"R:timeout=5s:0.0.0.0:2222:localhost:22",
+		},
+		{
+			"tz=UTC:schedule=2200-0600:3000",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "127.0.0.1",
+				RemotePort: "3000",
+				Schedule:   "2200-0600",
+				ScheduleTZ: "UTC",
+				schedule:   &schedule{start: 22 * 60, end: 6 * 60, loc: time.UTC},
+			},
+			"schedule=2200-0600:tz=UTC:0.0.0.0:3000:127.0.0.1:3000",
+		},
+		{
+			"tls-ca=/etc/ca.pem:3000:example.com:443",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "example.com",
+				RemotePort: "443",
+				TLSCA:      "/etc/ca.pem",
+				TLSOrigin:  true,
+			},
+			"tls-ca=/etc/ca.pem:0.0.0.0:3000:example.com:443",
+		},
+		{
+			"tls-key=key.pem:tls-cert=cert.pem:tls-origin=true:3000",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "127.0.0.1",
+				RemotePort: "3000",
+				TLSCert:    "cert.pem",
+				TLSKey:     "key.pem",
+				TLSOrigin:  true,
+			},
+			"tls-cert=cert.pem:tls-key=key.pem:tls-origin=true:0.0.0.0:3000:127.0.0.1:3000",
+		},
+		{
+			"conn-rate=2.5:weight=3:3000",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "127.0.0.1",
+				RemotePort: "3000",
+				Weight:     3,
+				ConnRate:   2.5,
+			},
+			"weight=3:conn-rate=2.5:0.0.0.0:3000:127.0.0.1:3000",
+		},
+		{
+			"timeout=5s:name=db:5432:db.internal:5432",
+			Remote{
+				LocalPort:   "5432",
+				RemoteHost:  "db.internal",
+				RemotePort:  "5432",
+				DialTimeout: 5 * time.Second,
+				Name:        "db",
+			},
+			"name=db:timeout=5s:0.0.0.0:5432:db.internal:5432",
+		},
+		{
+			"nodelay=false:3000:localhost:80",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "localhost",
+				RemotePort: "80",
+				NoDelay:    new(bool),
+			},
+			"nodelay=false:0.0.0.0:3000:localhost:80",
+		},
+		{
+			"max-lifetime=90m:3000",
+			Remote{
+				LocalPort:       "3000",
+				RemoteHost:      "127.0.0.1",
+				RemotePort:      "3000",
+				MaxConnLifetime: 90 * time.Minute,
+			},
+			"max-lifetime=1h30m0s:0.0.0.0:3000:127.0.0.1:3000",
+		},
+		{
+			"127.0.0.1,192.168.0.1:3000:localhost:80",
+			Remote{
+				LocalHost:  "127.0.0.1,192.168.0.1",
+				LocalPort:  "3000",
+				RemoteHost: "localhost",
+				RemotePort: "80",
+			},
+			"127.0.0.1,192.168.0.1:3000:localhost:80",
+		},
+		{
+			"balance=random:3000:web1*3,web2:80",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "web1*3,web2",
+				RemotePort: "80",
+				Balance:    BalanceRandom,
+			},
+			"balance=random:0.0.0.0:3000:web1*3,web2:80",
+		},
+		{
+			"fallback-direct=true:3000:intranet:80",
+			Remote{
+				LocalPort:      "3000",
+				RemoteHost:     "intranet",
+				RemotePort:     "80",
+				FallbackDirect: true,
+			},
+			"fallback-direct=true:0.0.0.0:3000:intranet:80",
+		},
+		{
+			"dial-backoff=200ms:dial-retries=3:3000:localhost:80",
+			Remote{
+				LocalPort:   "3000",
+				RemoteHost:  "localhost",
+				RemotePort:  "80",
+				DialRetries: 3,
+				DialBackoff: 200 * time.Millisecond,
+			},
+			"dial-retries=3:dial-backoff=200ms:0.0.0.0:3000:localhost:80",
+		},
 	} {
 		//expected defaults
 		expected := test.Output
@@ -106,3 +247,97 @@ func TestRemoteDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteCollides(t *testing.T) {
+	for i, test := range []struct {
+		A, B     string
+		Collides bool
+	}{
+		{"3000", "3000:google.com:80", true},
+		{"3000", "127.0.0.1:3000:google.com:80", true},
+		{"127.0.0.1:3000:google.com:80", "127.0.0.2:3000:google.com:80", false},
+		{"3000", "3000/udp", false},
+		{"3000/tcp+udp", "3000/udp", true},
+		{"3000", "3000/tcp+udp", true},
+		{"3000", "R:3000", false},
+		{"R:3000", "R:3000:google.com:80", true},
+		{"socks", "1080", true},
+		{"127.0.0.1,127.0.0.2:3000:google.com:80", "127.0.0.2:3000:google.com:80", true},
+		{"127.0.0.1,127.0.0.2:3000:google.com:80", "127.0.0.3,127.0.0.4:3000:google.com:80", false},
+	} {
+		a, err := DecodeRemote(test.A)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := DecodeRemote(test.B)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Collides(*b); got != test.Collides {
+			t.Fatalf("collide #%d '%s' '%s' expected %v got %v", i+1, test.A, test.B, test.Collides, got)
+		}
+	}
+}
+
+func TestRemoteSchedule(t *testing.T) {
+	r, err := DecodeRemote("schedule=2200-0600:tz=UTC:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Time string
+		In   bool
+	}{
+		{"21:59", false},
+		{"22:00", true},
+		{"03:00", true},
+		{"06:00", false},
+		{"12:00", false},
+	} {
+		at, _ := time.Parse("15:04", test.Time)
+		if got := r.InSchedule(at); got != test.In {
+			t.Fatalf("at %s expected %v got %v", test.Time, test.In, got)
+		}
+	}
+	if _, err := DecodeRemote("schedule=2500-0600:3000"); err == nil {
+		t.Fatal("expected invalid schedule error")
+	}
+}
+
+func TestRemoteLocalHosts(t *testing.T) {
+	r, err := DecodeRemote("R:127.0.0.1,10.0.0.1:3000:localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := r.Locals(); !reflect.DeepEqual(l, []string{"127.0.0.1:3000", "10.0.0.1:3000"}) {
+		t.Fatalf("unexpected locals %v", l)
+	}
+	//each is checked against the user's addresses
+	if a := r.UserAddrs(); !reflect.DeepEqual(a, []string{"R:127.0.0.1:3000", "R:10.0.0.1:3000"}) {
+		t.Fatalf("unexpected user addrs %v", a)
+	}
+	for _, s := range []string{"127.0.0.1,10.0.0.1:53:1.1.1.1:53/udp", "127.0.0.1,:3000:localhost:80"} {
+		if _, err := DecodeRemote(s); err == nil {
+			t.Fatalf("expected %s to be invalid", s)
+		}
+	}
+}
+
+func TestRemoteTargets(t *testing.T) {
+	r, err := DecodeRemote("3000:web1*3,web2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := r.Targets(); !reflect.DeepEqual(ts, []Target{{"web1:80", 3}, {"web2:80", 1}}) {
+		t.Fatalf("unexpected targets %v", ts)
+	}
+	//each is checked against the user's addresses
+	if a := r.UserAddrs(); !reflect.DeepEqual(a, []string{"web1:80", "web2:80"}) {
+		t.Fatalf("unexpected user addrs %v", a)
+	}
+	for _, s := range []string{"3000:web1*0,web2:80", "3000:web1,:80", "53:dns1,dns2:53/udp", "balance=random:3000:web1:80", "balance=least-conn:3000:web1,web2:80"} {
+		if _, err := DecodeRemote(s); err == nil {
+			t.Fatalf("expected %s to be invalid", s)
+		}
+	}
+}
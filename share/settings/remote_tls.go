@@ -0,0 +1,58 @@
+package settings
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+//ListenTLSConfig loads the certificate used to terminate
+//TLS on this remote's listener, nil when not configured.
+//Paths are resolved on the endpoint which binds the listener,
+//within the TLSDir when set.
+func (r Remote) ListenTLSConfig() (*tls.Config, error) {
+	if r.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.tlsFile(r.TLSCert), r.tlsFile(r.TLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("Remote '%s': tls-cert: %s", r, err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+//DialTLSConfig returns the config used to originate TLS
+//towards this remote's target, nil when not configured.
+//Without a tls-ca, the system roots are used.
+func (r Remote) DialTLSConfig() (*tls.Config, error) {
+	if !r.TLSOrigin {
+		return nil, nil
+	}
+	c := &tls.Config{
+		ServerName: r.RemoteHost,
+	}
+	if r.TLSCA != "" {
+		b, err := ioutil.ReadFile(r.tlsFile(r.TLSCA))
+		if err != nil {
+			return nil, fmt.Errorf("Remote '%s': tls-ca: %s", r, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("Remote '%s': tls-ca: no certificates found", r)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
+
+//tlsFile resolves a tls file option
+func (r Remote) tlsFile(name string) string {
+	if r.TLSDir == "" {
+		return name
+	}
+	return filepath.Join(r.TLSDir, name)
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//connRateMaxWait is the longest a connection is queued for,
+//before it's rejected instead
+const connRateMaxWait = time.Second
+
+//connLimiter is a token bucket of new connections per
+//second, holding up to a second's worth of tokens
+type connLimiter struct {
+	mut    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newConnLimiter(rate float64) *connLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &connLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+//reserve takes a token, returning how long until it's
+//available, nil limiters are unlimited
+func (c *connLimiter) reserve() time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	now := time.Now()
+	c.tokens += c.rate * now.Sub(c.last).Seconds()
+	if c.tokens > c.burst {
+		c.tokens = c.burst
+	}
+	c.last = now
+	c.tokens--
+	if c.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-c.tokens / c.rate * float64(time.Second))
+}
+
+//cancel returns a reserved token
+func (c *connLimiter) cancel() {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	c.tokens++
+	c.mut.Unlock()
+}
+
+func (t *Tunnel) connLimiter() *connLimiter {
+	return t.connLimit
+}
+
+//admit waits until a new connection is allowed by both the tunnel's
+//MaxConnRate and the remote's conn-rate, connections which would
+//wait longer than connRateMaxWait are rejected
+func (p *Proxy) admit(ctx context.Context) bool {
+	global := p.sshTun.connLimiter()
+	wait := global.reserve()
+	if d := p.connLimit.reserve(); d > wait {
+		wait = d
+	}
+	if wait > connRateMaxWait {
+		global.cancel()
+		p.connLimit.cancel()
+		atomic.AddInt64(&p.stats.rejected, 1)
+		return false
+	}
+	p.stats.accepts.add()
+	if wait == 0 {
+		return true
+	}
+	atomic.AddInt64(&p.stats.throttled, 1)
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//rateCounter counts events in the current and previous second
+type rateCounter struct {
+	mut    sync.Mutex
+	second int64
+	count  int64
+	prev   int64
+}
+
+func (r *rateCounter) add() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	s := time.Now().Unix()
+	if s != r.second {
+		if s == r.second+1 {
+			r.prev = r.count
+		} else {
+			r.prev = 0
+		}
+		r.second = s
+		r.count = 0
+	}
+	r.count++
+}
+
+//rate is the number of events in the last full second
+func (r *rateCounter) rate() int64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	switch time.Now().Unix() {
+	case r.second:
+		return r.prev
+	case r.second + 1:
+		return r.count
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//ConnInfo describes an open tcp connection of a remote
+type ConnInfo struct {
+	//ID identifies the connection to CloseConnection
+	ID string
+	//Remote is the encoded remote, empty
+	//when the peer didn't identify it
+	Remote string
+	//LocalAddr and RemoteAddr are those of this side's tcp
+	//connection, either accepted by a listening remote or
+	//dialed to a remote's target
+	LocalAddr  string
+	RemoteAddr string
+	Opened     time.Time
+	//Sent (towards the target) and Received bytes
+	Sent, Received int64
+}
+
+//trackedConn is an open connection in the registry
+type trackedConn struct {
+	info           ConnInfo
+	sent, received int64
+	closers        []io.Closer
+	closeOnce      sync.Once
+}
+
+func (c *trackedConn) addSent(n int64) {
+	if c != nil {
+		atomic.AddInt64(&c.sent, n)
+	}
+}
+
+func (c *trackedConn) addReceived(n int64) {
+	if c != nil {
+		atomic.AddInt64(&c.received, n)
+	}
+}
+
+//close both ends, which unblocks the pipe
+func (c *trackedConn) close() {
+	c.closeOnce.Do(func() {
+		for _, cl := range c.closers {
+			cl.Close()
+		}
+	})
+}
+
+//connRegistry indexes the open connections of a tunnel
+type connRegistry struct {
+	mut   sync.Mutex
+	next  int64
+	conns map[string]*trackedConn
+}
+
+//trackConn adds conn (this side's tcp connection) to the registry,
+//the closers are closed by CloseConnection, call untrackConn once
+//the connection is closed
+func (t *Tunnel) trackConn(r *settings.Remote, conn net.Conn, closers ...io.Closer) *trackedConn {
+	c := &trackedConn{closers: closers}
+	c.info.Opened = time.Now()
+	if r != nil {
+		c.info.Remote = r.Encode()
+	}
+	if conn != nil {
+		c.info.LocalAddr = conn.LocalAddr().String()
+		c.info.RemoteAddr = conn.RemoteAddr().String()
+	}
+	t.conns.mut.Lock()
+	defer t.conns.mut.Unlock()
+	if t.conns.conns == nil {
+		t.conns.conns = map[string]*trackedConn{}
+	}
+	t.conns.next++
+	c.info.ID = strconv.FormatInt(t.conns.next, 10)
+	t.conns.conns[c.info.ID] = c
+	return c
+}
+
+func (t *Tunnel) untrackConn(c *trackedConn) {
+	t.conns.mut.Lock()
+	defer t.conns.mut.Unlock()
+	delete(t.conns.conns, c.info.ID)
+}
+
+//Connections returns the open tcp connections, oldest first
+func (t *Tunnel) Connections() []ConnInfo {
+	t.conns.mut.Lock()
+	conns := make([]ConnInfo, 0, len(t.conns.conns))
+	for _, c := range t.conns.conns {
+		info := c.info
+		info.Sent = atomic.LoadInt64(&c.sent)
+		info.Received = atomic.LoadInt64(&c.received)
+		conns = append(conns, info)
+	}
+	t.conns.mut.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		a, _ := strconv.ParseInt(conns[i].ID, 10, 64)
+		b, _ := strconv.ParseInt(conns[j].ID, 10, 64)
+		return a < b
+	})
+	return conns
+}
+
+//CloseConnection closes the open connection with the given ID,
+//both its local and tunnelled ends are closed immediately
+func (t *Tunnel) CloseConnection(id string) error {
+	t.conns.mut.Lock()
+	c, ok := t.conns.conns[id]
+	delete(t.conns.conns, id)
+	t.conns.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown connection '%s'", id)
+	}
+	atomic.AddInt64(&t.stats.closed, 1)
+	c.close()
+	return nil
+}
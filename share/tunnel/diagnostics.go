@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"runtime/pprof"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//stallRWC logs writes which block for longer than after,
+//the peer is not reading (or the tunnel is congested)
+type stallRWC struct {
+	io.ReadWriteCloser
+	l     *cio.Logger
+	after time.Duration
+	desc  string
+}
+
+func (s *stallRWC) Write(p []byte) (int, error) {
+	t0 := time.Now()
+	timer := time.AfterFunc(s.after, func() {
+		s.l.Infof("Write to %s stalled for over %s", s.desc, s.after)
+	})
+	n, err := s.ReadWriteCloser.Write(p)
+	if !timer.Stop() {
+		s.l.Infof("Write to %s resumed after %s", s.desc, time.Since(t0).Round(time.Millisecond))
+	}
+	return n, err
+}
+
+//watchStalls logs writes to rwc which exceed the StallThreshold
+func (t *Tunnel) watchStalls(rwc io.ReadWriteCloser, l *cio.Logger, desc string) io.ReadWriteCloser {
+	if t.Config.StallThreshold <= 0 {
+		return rwc
+	}
+	return withCloseWrite(rwc, &stallRWC{ReadWriteCloser: rwc, l: l, after: t.Config.StallThreshold, desc: desc})
+}
+
+//logSlowDial logs dials which took longer than the SlowDialThreshold
+func (t *Tunnel) logSlowDial(l *cio.Logger, hostPort, spec string, took time.Duration) {
+	if t.Config.SlowDialThreshold > 0 && took > t.Config.SlowDialThreshold {
+		l.Infof("Slow dial to %s (%s) took %s", hostPort, spec, took)
+	}
+}
+
+//profiled runs f with the remote's pprof label when ProfileLabels
+//is set, goroutines started by f inherit it
+func (t *Tunnel) profiled(r *settings.Remote, addr string, f func()) {
+	if !t.Config.ProfileLabels {
+		f()
+		return
+	}
+	if r != nil {
+		addr = r.String()
+	}
+	pprof.Do(context.Background(), pprof.Labels("remote", addr), func(context.Context) {
+		f()
+	})
+}
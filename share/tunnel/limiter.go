@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//limiterTick is how often the limiter hands out tokens
+const limiterTick = 10 * time.Millisecond
+
+//limiter is a token bucket shared by all remotes of a tunnel.
+//Each tick, the tick's tokens are divided among the remotes
+//currently waiting for them, in proportion to their weights,
+//so an idle remote leaves its share to the busy ones, while
+//a greedy remote can't starve the others.
+type limiter struct {
+	rate    float64 //bytes per second
+	mut     sync.Mutex
+	cond    *sync.Cond
+	flows   map[string]*flow
+	running bool
+}
+
+//flow is a remote's share of the limiter
+type flow struct {
+	weight  float64
+	tokens  float64
+	waiting int
+	//bytes taken since the last tick,
+	//and the smoothed bytes per second
+	taken      int64
+	throughput float64
+}
+
+func newLimiter(bytesPerSecond int64) *limiter {
+	l := &limiter{
+		rate:  float64(bytesPerSecond),
+		flows: map[string]*flow{},
+	}
+	l.cond = sync.NewCond(&l.mut)
+	return l
+}
+
+//flow returns the flow of the given key, weights below one are one
+func (l *limiter) flow(key string, weight int) *flow {
+	if weight < 1 {
+		weight = 1
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, ok := l.flows[key]
+	if !ok {
+		f = &flow{}
+		l.flows[key] = f
+	}
+	f.weight = float64(weight)
+	return f
+}
+
+//take blocks until at least one token is available,
+//then takes up to n of them
+func (l *limiter) take(f *flow, n int) int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for f.tokens < 1 {
+		f.waiting++
+		if !l.running {
+			l.running = true
+			go l.refill()
+		}
+		l.cond.Wait()
+		f.waiting--
+	}
+	if t := int(f.tokens); n > t {
+		n = t
+	}
+	f.tokens -= float64(n)
+	f.taken += int64(n)
+	return n
+}
+
+//charge blocks until n tokens have been taken
+func (l *limiter) charge(f *flow, n int) {
+	for n > 0 {
+		n -= l.take(f, n)
+	}
+}
+
+//refund returns tokens which were taken but not used
+func (l *limiter) refund(f *flow, n int) {
+	if n <= 0 {
+		return
+	}
+	l.mut.Lock()
+	f.tokens += float64(n)
+	f.taken -= int64(n)
+	l.mut.Unlock()
+}
+
+//refill runs while there are waiting flows
+func (l *limiter) refill() {
+	ticker := time.NewTicker(limiterTick)
+	defer ticker.Stop()
+	last := time.Now()
+	idle := 0
+	for now := range ticker.C {
+		dt := now.Sub(last).Seconds()
+		last = now
+		l.mut.Lock()
+		total := 0.0
+		for _, f := range l.flows {
+			if f.waiting > 0 {
+				total += f.weight
+			}
+		}
+		budget := l.rate * dt
+		for _, f := range l.flows {
+			if f.waiting > 0 {
+				f.tokens += budget * f.weight / total
+			}
+			//similar to the keepalive latency gain
+			f.throughput += (float64(f.taken)/dt - f.throughput) / 8
+			f.taken = 0
+		}
+		if total == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		//stop after a second without demand
+		if idle >= int(time.Second/limiterTick) {
+			for _, f := range l.flows {
+				f.throughput = 0
+			}
+			l.running = false
+			l.mut.Unlock()
+			return
+		}
+		l.cond.Broadcast()
+		l.mut.Unlock()
+	}
+}
+
+//throughputs of each flow in bytes per second
+func (l *limiter) throughputs() map[string]float64 {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	m := make(map[string]float64, len(l.flows))
+	for k, f := range l.flows {
+		m[k] = f.throughput
+	}
+	return m
+}
+
+//limitedRWC rate limits both the reads
+//and writes of a ReadWriteCloser
+type limitedRWC struct {
+	io.ReadWriteCloser
+	l *limiter
+	f *flow
+}
+
+//Read charges for the bytes once read, reserving tokens
+//beforehand would let idle connections hoard them
+func (r *limitedRWC) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	r.l.charge(r.f, n)
+	return n, err
+}
+
+func (r *limitedRWC) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := r.l.take(r.f, len(p)-written)
+		w, err := r.ReadWriteCloser.Write(p[written : written+n])
+		written += w
+		if err != nil {
+			r.l.refund(r.f, n-w)
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+//limit shapes rwc (in both directions) under the tunnel's
+//MaxBandwidth, sharing it with other remotes by weight
+func (t *Tunnel) limit(rwc io.ReadWriteCloser, r *settings.Remote, addr string) io.ReadWriteCloser {
+	if t.limiter == nil {
+		return rwc
+	}
+	key, weight := addr, 1
+	if r != nil {
+		key, weight = r.String(), r.Weight
+	}
+	return withCloseWrite(rwc, &limitedRWC{ReadWriteCloser: rwc, l: t.limiter, f: t.limiter.flow(key, weight)})
+}
@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"net"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//Middleware wraps or inspects a tunneled connection, returning
+//the conn to use in its place, or nil to drop the connection
+type Middleware func(remote settings.Remote, c net.Conn) net.Conn
+
+//apply the middleware to c, a nil result closes c.
+//The remote is zero when unknown.
+func (m Middleware) apply(remote *settings.Remote, c net.Conn) net.Conn {
+	if m == nil {
+		return c
+	}
+	r := settings.Remote{}
+	if remote != nil {
+		r = *remote
+	}
+	wrapped := m(r, c)
+	if wrapped == nil {
+		c.Close()
+	}
+	return wrapped
+}
+
+func (t *Tunnel) connMiddleware() Middleware {
+	return t.Config.ConnMiddleware
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+)
+
+//multiListener accepts from several listeners, as one
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			m.errs <- err
+			return
+		}
+		select {
+		case m.conns <- c:
+		case <-m.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+//Accept the next connection from any listener, a listener
+//failing fails the multiListener (closing the others)
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case err := <-m.errs:
+		m.Close()
+		return nil, err
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+//Addr of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"net"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//noDelay is the remote's nodelay option, else the tunnel's
+func (t *Tunnel) noDelay(r *settings.Remote) *bool {
+	if r != nil && r.NoDelay != nil {
+		return r.NoDelay
+	}
+	return t.Config.NoDelay
+}
+
+//setNoDelay on tcp connections, nil keeps the default
+func setNoDelay(c net.Conn, noDelay *bool) {
+	if tcp, ok := c.(*net.TCPConn); ok && noDelay != nil {
+		tcp.SetNoDelay(*noDelay)
+	}
+}
+
+//noDelayListener sets TCP_NODELAY on accepted connections,
+//beneath any TLS listener
+type noDelayListener struct {
+	net.Listener
+	noDelay *bool
+}
+
+func (l noDelayListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		setNoDelay(c, l.noDelay)
+	}
+	return c, err
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//targetPool balances the connections of a remote
+//with a pool of remote hosts across its targets
+type targetPool struct {
+	mut     sync.Mutex
+	targets []settings.Target
+	random  bool
+	//current weights, for smooth weighted round-robin
+	current []int
+}
+
+func newTargetPool(r *settings.Remote) *targetPool {
+	t := r.Targets()
+	return &targetPool{
+		targets: t,
+		random:  r.Balance == settings.BalanceRandom,
+		current: make([]int, len(t)),
+	}
+}
+
+//order of the targets to dial for a connection, the picked
+//target first, then the rest in turn should its dial fail
+func (p *targetPool) order() []string {
+	p.mut.Lock()
+	i := p.pick()
+	p.mut.Unlock()
+	addrs := make([]string, len(p.targets))
+	for j := range p.targets {
+		addrs[j] = p.targets[(i+j)%len(p.targets)].Addr
+	}
+	return addrs
+}
+
+//pick a target by weight, mut must be held
+func (p *targetPool) pick() int {
+	total := 0
+	for _, t := range p.targets {
+		total += t.Weight
+	}
+	if p.random {
+		n := rand.Intn(total)
+		for i, t := range p.targets {
+			if n -= t.Weight; n < 0 {
+				return i
+			}
+		}
+	}
+	//each target gains its weight, the heaviest is
+	//picked and loses the total, which spreads picks
+	best := 0
+	for i, t := range p.targets {
+		p.current[i] += t.Weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	return best
+}
+
+//targets to dial for a connection of the given remote, addr
+//is dialed directly unless the remote has a pool of targets
+func (t *Tunnel) targets(r *settings.Remote, addr string) []string {
+	if r == nil || len(r.Targets()) == 1 && r.Targets()[0].Addr == addr {
+		return []string{addr}
+	}
+	key := r.Encode()
+	t.poolMut.Lock()
+	p, ok := t.pools[key]
+	if !ok {
+		if t.pools == nil {
+			t.pools = map[string]*targetPool{}
+		}
+		p = newTargetPool(r)
+		t.pools[key] = p
+	}
+	t.poolMut.Unlock()
+	return p.order()
+}
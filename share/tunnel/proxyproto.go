@@ -0,0 +1,21 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+//proxyHeader is a PROXY protocol v1 header describing
+//a connection from src to dst (see haproxy's proxy-protocol.txt)
+func proxyHeader(src, dst net.Addr) []byte {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if s.IP.To4() == nil || d.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/armon/go-socks5"
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+const (
+	socks4Version  = 4
+	socks5Version  = 5
+	socks4Connect  = 1
+	socks4Granted  = 90
+	socks4Rejected = 91
+	//limits userid and hostname fields
+	socks4MaxField = 255
+)
+
+//handleSocks detects the SOCKS version from the first byte, SOCKS5
+//is served by the socks5 server, SOCKS4 and 4a are handled here
+func (t *Tunnel) handleSocks(src io.ReadWriteCloser, remote *settings.Remote) error {
+	br := bufio.NewReader(src)
+	v, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	//replay the peeked bytes
+	conn := &peekedRWC{Reader: br, ReadWriteCloser: src}
+	switch v[0] {
+	case socks5Version:
+		//a server per connection, so dials use the remote's options
+		c := *t.socksConfig
+		c.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dialSocks(ctx, remote, network, addr)
+		}
+		s, err := socks5.New(&c)
+		if err != nil {
+			return err
+		}
+		return s.ServeConn(cnet.NewRWCConn(conn))
+	case socks4Version:
+		return t.handleSocks4(br, conn, remote)
+	}
+	return fmt.Errorf("unsupported SOCKS version %d", v[0])
+}
+
+//dialResolver leaves SOCKS5 hostnames unresolved, so they reach
+//dialSocks (and the DialFilter) as is, and are resolved by the dial
+type dialResolver struct{}
+
+func (dialResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+type peekedRWC struct {
+	io.Reader
+	io.ReadWriteCloser
+}
+
+func (p *peekedRWC) Read(b []byte) (int, error) {
+	return p.Reader.Read(b)
+}
+
+//handleSocks4 serves a SOCKS4 or 4a CONNECT request, replying
+//with a rejection to requests which can't be served
+func (t *Tunnel) handleSocks4(br *bufio.Reader, conn io.ReadWriteCloser, remote *settings.Remote) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	if _, err := readSocks4Field(br); err != nil {
+		return err
+	}
+	port := int(header[2])<<8 | int(header[3])
+	host := net.IP(header[4:8]).String()
+	//4a, 0.0.0.x is followed by the hostname
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		name, err := readSocks4Field(br)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			conn.Write(socks4Reply(socks4Rejected))
+			return errors.New("SOCKS4a request without hostname")
+		}
+		host = name
+	}
+	if header[1] != socks4Connect {
+		conn.Write(socks4Reply(socks4Rejected))
+		return fmt.Errorf("unsupported SOCKS4 command %d", header[1])
+	}
+	ctx := context.Background()
+	if t.Config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Config.DialTimeout)
+		defer cancel()
+	}
+	addr, err := t.filterDial(ctx, t.Logger, remote, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		conn.Write(socks4Reply(socks4Rejected))
+		return err
+	}
+	d := net.Dialer{}
+	dst, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		conn.Write(socks4Reply(socks4Rejected))
+		return err
+	}
+	setNoDelay(dst, t.noDelay(remote))
+	if dst = t.Config.DialMiddleware.apply(remote, dst); dst == nil {
+		conn.Write(socks4Reply(socks4Rejected))
+		return errors.New("dropped by middleware")
+	}
+	if _, err := conn.Write(socks4Reply(socks4Granted)); err != nil {
+		dst.Close()
+		return err
+	}
+	cio.Pipe(conn, dst)
+	return nil
+}
+
+//readSocks4Field reads a null terminated field
+func readSocks4Field(br *bufio.Reader) (string, error) {
+	b := []byte{}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxField {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		b = append(b, c)
+	}
+}
+
+//socks4Reply with the given status, the address is ignored by clients
+func socks4Reply(status byte) []byte {
+	return []byte{0, status, 0, 0, 0, 0, 0, 0}
+}
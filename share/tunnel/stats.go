@@ -0,0 +1,311 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//Stats is a snapshot of a Tunnel's counters
+type Stats struct {
+	//DialTimeouts is the number of outbound
+	//dials which exceeded their timeout
+	DialTimeouts int64
+	//DialRetries is the number of outbound dials retried,
+	//under the remotes' dial-retries option
+	DialRetries int64
+	//Pings and PingFailures count keepalives
+	Pings, PingFailures int64
+	//Traffic and Admission across all remotes
+	Traffic
+	Admission
+	//Expired is the number of connections closed
+	//for exceeding their remote's max-lifetime
+	Expired int64
+	//Closed is the number of connections
+	//closed by Tunnel.CloseConnection
+	Closed int64
+	//Remotes holds the counters of each remote
+	Remotes map[string]RemoteStats
+}
+
+//StatsLabels is how Stats.Remotes are keyed (e.g. labelled when
+//exported as metrics), to bound their number with dynamic remotes
+type StatsLabels int
+
+const (
+	//LabelBySpec keys remotes by their spec, and connections to
+	//dynamic targets (e.g. via socks) by address, the default
+	LabelBySpec StatsLabels = iota
+	//LabelByName keys remotes by their name option, those
+	//without one are combined under UnnamedRemotes
+	LabelByName
+	//LabelNone only keeps the totals, Stats.Remotes is empty
+	LabelNone
+)
+
+//UnnamedRemotes is the Stats.Remotes key of the remotes
+//without a name option, under LabelByName
+const UnnamedRemotes = "unnamed"
+
+//RemoteStats is a snapshot of a single remote's counters
+type RemoteStats struct {
+	Traffic
+	Admission
+	//Throughput is the recent bytes per second (in both
+	//directions) of a remote, known only under MaxBandwidth
+	Throughput float64
+	//Expired connections exceeded the max-lifetime
+	Expired int64
+	//DialRetries counts the retried dials of the remote's target
+	DialRetries int64
+	//Targets counts the connections to each target
+	//of remotes with a pool of remote hosts
+	Targets map[string]int64
+}
+
+//Traffic counts bytes in each direction (Sent is towards the remote's
+//target), both before compression (application bytes) and after it
+//(wire bytes). Without compression these are equal.
+type Traffic struct {
+	Sent, Received         int64
+	WireSent, WireReceived int64
+}
+
+//Ratio is the effective compression ratio of the traffic
+func (t Traffic) Ratio() float64 {
+	wire := t.WireSent + t.WireReceived
+	if wire == 0 {
+		return 1
+	}
+	return float64(t.Sent+t.Received) / float64(wire)
+}
+
+//Admission counts the new connections of listeners
+type Admission struct {
+	//ConnRate is the number of connections
+	//accepted during the last second
+	ConnRate int64
+	//Throttled connections were delayed by a
+	//connection rate limit, Rejected ones closed
+	Throttled, Rejected int64
+}
+
+func (a *Admission) add(o Admission) {
+	a.ConnRate += o.ConnRate
+	a.Throttled += o.Throttled
+	a.Rejected += o.Rejected
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.Sent += o.Sent
+	t.Received += o.Received
+	t.WireSent += o.WireSent
+	t.WireReceived += o.WireReceived
+}
+
+type tunnelStats struct {
+	dialTimeouts int64
+	dialRetries  int64
+	closed       int64
+	pings        int64
+	pingFailures int64
+	//smoothed keepalive rtt and failure rate
+	latency      ewma
+	pingFailRate ewma
+	mut          sync.Mutex
+	remotes      map[string]*remoteStats
+	//labels of the limiter's flows, which are per remote
+	labels map[string]string
+}
+
+//ewma is an exponentially weighted moving average,
+//where each new sample carries the given weight
+type ewma struct {
+	mut    sync.Mutex
+	weight float64
+	value  float64
+	init   bool
+}
+
+func (e *ewma) add(sample float64) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if !e.init {
+		e.value = sample
+		e.init = true
+		return
+	}
+	e.value += e.weight * (sample - e.value)
+}
+
+func (e *ewma) get() float64 {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.value
+}
+
+//remoteStats are the live counters of a remote
+type remoteStats struct {
+	sent, received         int64
+	wireSent, wireReceived int64
+	throttled, rejected    int64
+	expired                int64
+	dialRetries            int64
+	accepts                rateCounter
+	targetsMut             sync.Mutex
+	targets                map[string]int64
+}
+
+//addTarget counts a connection to a target of a pool
+func (r *remoteStats) addTarget(addr string) {
+	r.targetsMut.Lock()
+	defer r.targetsMut.Unlock()
+	if r.targets == nil {
+		r.targets = map[string]int64{}
+	}
+	r.targets[addr]++
+}
+
+//addTraffic records application bytes copied in each direction,
+//along with the bytes that crossed the wire once compressed
+func (r *remoteStats) addTraffic(sent, received, wireSent, wireReceived int64) {
+	atomic.AddInt64(&r.sent, sent)
+	atomic.AddInt64(&r.received, received)
+	atomic.AddInt64(&r.wireSent, wireSent)
+	atomic.AddInt64(&r.wireReceived, wireReceived)
+}
+
+//addSent and addReceived record bytes as they are copied,
+//without stream compression, wire bytes equal application bytes
+func (r *remoteStats) addSent(n int64) {
+	r.addTraffic(n, 0, n, 0)
+}
+
+func (r *remoteStats) addReceived(n int64) {
+	r.addTraffic(0, n, 0, n)
+}
+
+func (r *remoteStats) snapshot() RemoteStats {
+	return RemoteStats{
+		Traffic: Traffic{
+			Sent:         atomic.LoadInt64(&r.sent),
+			Received:     atomic.LoadInt64(&r.received),
+			WireSent:     atomic.LoadInt64(&r.wireSent),
+			WireReceived: atomic.LoadInt64(&r.wireReceived),
+		},
+		Admission: Admission{
+			ConnRate:  r.accepts.rate(),
+			Throttled: atomic.LoadInt64(&r.throttled),
+			Rejected:  atomic.LoadInt64(&r.rejected),
+		},
+		Expired:     atomic.LoadInt64(&r.expired),
+		DialRetries: atomic.LoadInt64(&r.dialRetries),
+		Targets:     r.targetsSnapshot(),
+	}
+}
+
+func (r *remoteStats) targetsSnapshot() map[string]int64 {
+	r.targetsMut.Lock()
+	defer r.targetsMut.Unlock()
+	if r.targets == nil {
+		return nil
+	}
+	t := make(map[string]int64, len(r.targets))
+	for addr, n := range r.targets {
+		t[addr] = n
+	}
+	return t
+}
+
+//remoteStats of the given remote, remotes unknown
+//to this tunnel are grouped by their address
+func (t *Tunnel) remoteStats(r *settings.Remote, addr string) *remoteStats {
+	flow, key := addr, addr
+	if r != nil {
+		flow, key = r.String(), r.String()
+	}
+	switch t.Config.StatsLabels {
+	case LabelByName:
+		key = UnnamedRemotes
+		if r != nil && r.Name != "" {
+			key = r.Name
+		}
+	case LabelNone:
+		key = ""
+	}
+	t.stats.mut.Lock()
+	defer t.stats.mut.Unlock()
+	if t.stats.remotes == nil {
+		t.stats.remotes = map[string]*remoteStats{}
+		t.stats.labels = map[string]string{}
+	}
+	t.stats.labels[flow] = key
+	s, ok := t.stats.remotes[key]
+	if !ok {
+		s = &remoteStats{}
+		t.stats.remotes[key] = s
+	}
+	return s
+}
+
+//Stats returns a snapshot of the tunnel's counters
+func (t *Tunnel) Stats() Stats {
+	s := Stats{
+		DialTimeouts: atomic.LoadInt64(&t.stats.dialTimeouts),
+		DialRetries:  atomic.LoadInt64(&t.stats.dialRetries),
+		Closed:       atomic.LoadInt64(&t.stats.closed),
+		Pings:        atomic.LoadInt64(&t.stats.pings),
+		PingFailures: atomic.LoadInt64(&t.stats.pingFailures),
+		Remotes:      map[string]RemoteStats{},
+	}
+	t.stats.mut.Lock()
+	defer t.stats.mut.Unlock()
+	for k, r := range t.stats.remotes {
+		rs := r.snapshot()
+		s.Remotes[k] = rs
+		s.Traffic.add(rs.Traffic)
+		s.Admission.add(rs.Admission)
+		s.Expired += rs.Expired
+	}
+	if t.limiter != nil {
+		for flow, tp := range t.limiter.throughputs() {
+			k, ok := t.stats.labels[flow]
+			if !ok {
+				continue
+			}
+			rs := s.Remotes[k]
+			rs.Throughput += tp
+			s.Remotes[k] = rs
+		}
+	}
+	if t.Config.StatsLabels == LabelNone {
+		s.Remotes = map[string]RemoteStats{}
+	}
+	return s
+}
+
+//recordPing updates the keepalive counters and averages
+func (s *tunnelStats) recordPing(rtt time.Duration, err error) {
+	atomic.AddInt64(&s.pings, 1)
+	if err != nil {
+		atomic.AddInt64(&s.pingFailures, 1)
+		s.pingFailRate.add(1)
+		return
+	}
+	s.pingFailRate.add(0)
+	s.latency.add(float64(rtt))
+}
+
+//SmoothedLatency is an exponentially weighted moving
+//average of the keepalive round trip times
+func (t *Tunnel) SmoothedLatency() time.Duration {
+	return time.Duration(t.stats.latency.get())
+}
+
+//PingFailureRate is the recent fraction (0 to 1) of failed keepalives
+func (t *Tunnel) PingFailureRate() float64 {
+	return t.stats.pingFailRate.get()
+}
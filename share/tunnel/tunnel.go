@@ -3,11 +3,16 @@ package tunnel
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -25,6 +30,69 @@ type Config struct {
 	Outbound  bool
 	Socks     bool
 	KeepAlive time.Duration
+	//KeepAliveTimeout is how long to wait for a keepalive
+	//reply (defaults to the KeepAlive interval)
+	KeepAliveTimeout time.Duration
+	//KeepAliveMaxFailures is the number of consecutive failed
+	//keepalives before the connection is closed (defaults to 1)
+	KeepAliveMaxFailures int
+	//DialTimeout limits outbound dials,
+	//unless overridden per remote
+	DialTimeout time.Duration
+	//ReconnectGrace keeps idle inbound connections open for up to
+	//this duration after the SSH connection is lost, bridging them
+	//to the next connection (see bridge)
+	ReconnectGrace time.Duration
+	//ConnectWait is how long new inbound connections wait for an SSH
+	//connection while disconnected, before they are closed (defaults
+	//to 35s, a bit longer than the ssh handshake timeout)
+	ConnectWait time.Duration
+	//MaxBandwidth caps the bytes per second read across all
+	//tcp remotes, which share it by weight (zero is unlimited)
+	MaxBandwidth int64
+	//MaxConnRate limits new connections per second
+	//across all tcp listeners (zero is unlimited)
+	MaxConnRate float64
+	//SlowDialThreshold logs outbound dials which take longer
+	SlowDialThreshold time.Duration
+	//StallThreshold logs writes which block for longer, where the
+	//receiving end stopped reading or the tunnel is congested
+	StallThreshold time.Duration
+	//NoDelay sets TCP_NODELAY on accepted and dialed tcp
+	//connections, unless set by the remote's nodelay option. Go
+	//enables it by default (nil), lowering latency for interactive
+	//protocols, disabling it enables Nagle's algorithm, which sends
+	//fewer, fuller packets, at the cost of latency for small writes.
+	NoDelay *bool
+	//CopyBufferSize is the buffer size of each direction of a
+	//tcp connection (defaults to cio.DefaultBufferSize), larger
+	//buffers suit links with a high bandwidth-delay product
+	CopyBufferSize int
+	//StatsLabels keys Stats.Remotes, defaults to LabelBySpec
+	StatsLabels StatsLabels
+	//ProfileLabels sets a pprof "remote" label (the remote's
+	//spec, or the target address) on the goroutines copying each
+	//tcp connection, so CPU profiles can be attributed to remotes
+	ProfileLabels bool
+	//OutboundRemotes are the remotes whose
+	//outbound connections this tunnel dials
+	OutboundRemotes settings.Remotes
+	//RequestHandlers handle additional SSH global
+	//requests by type, unknown types are rejected
+	RequestHandlers map[string]func(payload []byte) (ok bool, reply []byte)
+	//DialFilter is called before each outbound dial (tcp, udp and
+	//socks), returning the address to dial instead, or an error to
+	//refuse the connection. The remote is zero when unknown. Hostnames
+	//are passed unresolved, including those of SOCKS requests.
+	DialFilter func(ctx context.Context, remote settings.Remote, network, addr string) (string, error)
+	//ConnMiddleware is applied to each accepted tcp connection,
+	//DialMiddleware to each dialed one (after any TLS), the returned
+	//conn is used in place of the original, nil drops it
+	ConnMiddleware Middleware
+	DialMiddleware Middleware
+	//DirectDial dials the remotes with fallback-direct, for the
+	//connections accepted while disconnected (defaults to net.Dialer)
+	DirectDial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 //Tunnel represents an SSH tunnel with proxy capabilities.
@@ -37,22 +105,55 @@ type Config struct {
 type Tunnel struct {
 	Config
 	//ssh connection
+	rtt            int64
 	activeConnMut  sync.RWMutex
-	activatingConn chan ssh.Conn
+	activatingConn chan struct{}
 	activeConn     ssh.Conn
+	activeDone     chan struct{}
+	//demand is signalled by connections waiting while disconnected
+	demand chan struct{}
 	//proxies
+	proxyMut   sync.Mutex
 	proxyCount int
+	//guards OutboundRemotes
+	outboundMut sync.RWMutex
+	//set once the peer identifies channels, see SetRemoteIDs
+	remoteIDs int32
+	//tls origination configs by remote
+	tlsMut  sync.Mutex
+	dialTLS map[string]*tls.Config
+	//target pools by remote
+	poolMut sync.Mutex
+	pools   map[string]*targetPool
+	//live keepalive interval, see SetKeepAlive
+	keepAliveMut     sync.Mutex
+	keepAlive        time.Duration
+	keepAliveChanged chan struct{}
 	//internals
 	connStats   cnet.ConnCount
-	socksServer *socks5.Server
+	conns       connRegistry
+	stats       tunnelStats
+	socksConfig *socks5.Config
+	limiter     *limiter
+	connLimit   *connLimiter
 }
 
 //New Tunnel from the given Config
 func New(c Config) *Tunnel {
 	c.Logger = c.Logger.Fork("tun")
 	t := &Tunnel{
-		Config: c,
+		Config:           c,
+		keepAlive:        c.KeepAlive,
+		keepAliveChanged: make(chan struct{}),
+		demand:           make(chan struct{}, 1),
 	}
+	//similar to the tcp srtt gain
+	t.stats.latency.weight = 1.0 / 8
+	t.stats.pingFailRate.weight = 1.0 / 8
+	if c.MaxBandwidth > 0 {
+		t.limiter = newLimiter(c.MaxBandwidth)
+	}
+	t.connLimit = newConnLimiter(c.MaxConnRate)
 	//setup socks server (not listening on any port!)
 	extra := ""
 	if c.Socks {
@@ -60,7 +161,7 @@ func New(c Config) *Tunnel {
 		if t.Logger.Debug {
 			sl = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
 		}
-		t.socksServer, _ = socks5.New(&socks5.Config{Logger: sl})
+		t.socksConfig = &socks5.Config{Logger: sl, Resolver: dialResolver{}}
 		extra += " (SOCKS enabled)"
 	}
 	t.Debugf("Created%s", extra)
@@ -77,88 +178,186 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 		}
 	}()
 	//mark active
+	done := make(chan struct{})
 	t.activeConnMut.Lock()
 	if t.activeConn != nil {
 		panic("double bind ssh")
 	}
 	t.activeConn = c
-	t.activeConnMut.Unlock()
-	//fetch chan
-	t.activeConnMut.RLock()
-	ch := t.activatingConn
-	t.activeConnMut.RUnlock()
-	//pass conn to getter, if any
-	if ch != nil {
-		ch <- c
-		close(ch) //only use once
-	}
-	//optional keepalive loop against this connection
-	if t.Config.KeepAlive > 0 {
-		go t.keepAliveLoop(c)
+	t.activeDone = done
+	//wake getters, if any
+	if t.activatingConn != nil {
+		close(t.activatingConn)
+		t.activatingConn = nil
 	}
+	t.activeConnMut.Unlock()
+	//keepalive loop against this connection,
+	//idle until there's a keepalive interval
+	dead := make(chan struct{}, 1)
+	go t.keepAliveLoop(c, done, dead)
 	//block until closed
 	go t.handleSSHRequests(reqs)
 	go t.handleSSHChannels(chans)
 	t.Debugf("SSH connected")
 	err := c.Wait()
-	t.Debugf("SSH disconnected")
-	//mark inactive
+	//mark inactive, before notifying getSession callers
 	t.activeConnMut.Lock()
 	t.activeConn = nil
+	t.activeDone = nil
 	t.activeConnMut.Unlock()
+	close(done)
+	atomic.StoreInt64(&t.rtt, 0)
+	t.Debugf("SSH disconnected")
+	select {
+	case <-dead:
+		//rather than the error of the closed conn
+		return ErrKeepAliveFailed
+	default:
+	}
 	return err
 }
 
-//getSSH can only have 1 caller
+//ErrKeepAliveFailed is returned by BindSSH when the
+//connection is closed by failed keepalives
+var ErrKeepAliveFailed = errors.New("keepalive failed")
+
+//defaultConnectWait is a bit longer than the ssh handshake timeout
+const defaultConnectWait = 35 * time.Second
+
+//getSSH returns the active connection, waiting
+//for one while the tunnel is disconnected
 func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
+	c, _ := t.getSession(ctx)
+	return c
+}
+
+//getSession is getSSH, along with a channel
+//which is closed once the connection is lost
+func (t *Tunnel) getSession(ctx context.Context) (ssh.Conn, <-chan struct{}) {
 	//cancelled already?
 	if isDone(ctx) {
-		return nil
+		return nil, nil
 	}
-	t.activeConnMut.RLock()
-	c := t.activeConn
-	t.activeConnMut.RUnlock()
+	t.activeConnMut.Lock()
+	c, done := t.activeConn, t.activeDone
 	//connected already?
 	if c != nil {
-		return c
+		t.activeConnMut.Unlock()
+		return c, done
 	}
-	//connecting...
-	t.activeConnMut.Lock()
-	if t.activatingConn != nil {
-		panic("multiple getters")
+	//signal the demand for a connection
+	select {
+	case t.demand <- struct{}{}:
+	default:
 	}
-	t.activatingConn = make(chan ssh.Conn)
+	//connecting, all getters share one chan
+	if t.activatingConn == nil {
+		t.activatingConn = make(chan struct{})
+	}
+	ch := t.activatingConn
 	t.activeConnMut.Unlock()
+	wait := t.Config.ConnectWait
+	if wait <= 0 {
+		wait = defaultConnectWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 	select {
 	case <-ctx.Done(): //cancelled
-		return nil
-	case <-time.After(35 * time.Second): //a bit longer than ssh timeout
-		return nil
-	case c := <-t.activatingConn:
-		t.activeConnMut.Lock()
-		t.activatingConn = nil
-		t.activeConnMut.Unlock()
-		return c
+		return nil, nil
+	case <-timer.C:
+		return nil, nil
+	case <-ch:
+		t.activeConnMut.RLock()
+		defer t.activeConnMut.RUnlock()
+		return t.activeConn, t.activeDone
+	}
+}
+
+//Demand receives once a connection waits for an SSH connection
+//while the tunnel is disconnected, such as a connection accepted
+//by a listening remote, for connecting on demand
+func (t *Tunnel) Demand() <-chan struct{} {
+	return t.demand
+}
+
+//ClearDemand discards any demand signalled before now
+func (t *Tunnel) ClearDemand() {
+	select {
+	case <-t.demand:
+	default:
 	}
 }
 
+//Activity of the tunnel's connections (in both directions), busy
+//while any are open, and a count which changes as each is opened
+func (t *Tunnel) Activity() (busy bool, opened int64) {
+	o, n := t.connStats.Counts()
+	t.conns.mut.Lock()
+	defer t.conns.mut.Unlock()
+	return o > 0 || len(t.conns.conns) > 0, int64(n) + t.conns.next
+}
+
 //BindRemotes converts the given remotes into proxies, and blocks
 //until the caller cancels the context or there is a proxy error.
 func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) error {
+	proxies, err := t.listenRemotes(ctx, remotes, false)
+	if err != nil {
+		if isDone(ctx) {
+			//cancelled mid-bind, nothing is left bound
+			return nil
+		}
+		return err
+	}
+	return t.RunProxies(ctx, proxies)
+}
+
+//ListenRemotes binds all of the given remotes, if any fail, those
+//already bound are closed. With alternate, a tcp remote whose port
+//is in use is bound to a free port instead, see Proxy.Port.
+func (t *Tunnel) ListenRemotes(remotes []*settings.Remote, alternate bool) ([]*Proxy, error) {
+	return t.listenRemotes(context.Background(), remotes, alternate)
+}
+
+//listenRemotes is ListenRemotes, stopping when ctx is
+//cancelled, closing those already bound
+func (t *Tunnel) listenRemotes(ctx context.Context, remotes []*settings.Remote, alternate bool) ([]*Proxy, error) {
 	if len(remotes) == 0 {
-		return nil
+		return nil, nil
 	}
 	if !t.Inbound {
-		return errors.New("inbound connections blocked")
+		return nil, errors.New("inbound connections blocked")
+	}
+	proxies := make([]*Proxy, 0, len(remotes))
+	closeAll := func() {
+		for _, p := range proxies {
+			p.Close()
+		}
 	}
-	proxies := make([]*Proxy, len(remotes))
-	for i, remote := range remotes {
-		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
+	for _, remote := range remotes {
+		if err := ctx.Err(); err != nil {
+			closeAll()
+			return nil, err
+		}
+		p, err := t.Listen(remote)
+		if _, inUse := err.(*portInUseError); inUse && alternate {
+			t.Infof("Port of %s in use, binding a free port instead", remote)
+			p, err = t.listenPort(remote, "0")
+		}
 		if err != nil {
-			return err
+			closeAll()
+			return nil, err
 		}
-		proxies[i] = p
-		t.proxyCount++
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+//RunProxies blocks until the caller cancels
+//the context or there is a proxy error
+func (t *Tunnel) RunProxies(ctx context.Context, proxies []*Proxy) error {
+	if len(proxies) == 0 {
+		return nil
 	}
 	//TODO: handle tunnel close
 	eg, ctx := errgroup.WithContext(ctx)
@@ -174,16 +373,237 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	return err
 }
 
-func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
+//Listen binds a single remote, the returned
+//Proxy must be Run to accept connections
+func (t *Tunnel) Listen(remote *settings.Remote) (*Proxy, error) {
+	return t.listenPort(remote, "")
+}
+
+//listenPort is Listen, binding the given tcp port instead of
+//the remote's when set, "0" binds a free port (see Proxy.Port)
+func (t *Tunnel) listenPort(remote *settings.Remote, port string) (*Proxy, error) {
+	if !t.Inbound {
+		return nil, errors.New("inbound connections blocked")
+	}
+	t.proxyMut.Lock()
+	index := t.proxyCount
+	t.proxyCount++
+	t.proxyMut.Unlock()
+	p, err := newProxy(t.Logger, t, index, remote, port)
+	if err != nil {
+		return nil, err
+	}
+	p.grace = t.Config.ReconnectGrace
+	p.bufferSize = t.Config.CopyBufferSize
+	return p, nil
+}
+
+//SetRemoteIDs sets whether the peer supports channels which
+//identify their remote, their extra data is then the address and
+//the remote's encoded spec, as several remotes may share an address
+func (t *Tunnel) SetRemoteIDs(enabled bool) {
+	v := int32(0)
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&t.remoteIDs, v)
+}
+
+//channelData is the extra data of a channel to addr for r
+func (t *Tunnel) channelData(r *settings.Remote, addr string) []byte {
+	if atomic.LoadInt32(&t.remoteIDs) == 0 {
+		return []byte(addr)
+	}
+	return []byte(addr + "\x00" + r.Encode())
+}
+
+//parseChannelData reverses channelData, older peers send no id
+func parseChannelData(b []byte) (addr, id string) {
+	s := string(b)
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+//outboundRemote finds the remote which requested a channel, by its id.
+//Older peers don't send ids, the remote is then found by its outbound
+//address, and when several remotes share an address the first one wins.
+func (t *Tunnel) outboundRemote(addr, id string) *settings.Remote {
+	t.outboundMut.RLock()
+	defer t.outboundMut.RUnlock()
+	for _, r := range t.OutboundRemotes {
+		if id != "" {
+			if r.Encode() == id {
+				return r
+			}
+			continue
+		}
+		a := r.Remote()
+		if r.RemoteProto == "udp" {
+			a += "/udp"
+		}
+		if a == addr || r.RemoteProto == settings.ProtoTCPUDP && a+"/udp" == addr {
+			return r
+		}
+	}
+	return nil
+}
+
+//AddOutboundRemote registers a remote whose outbound
+//connections this tunnel dials, after the tunnel has started
+func (t *Tunnel) AddOutboundRemote(r *settings.Remote) {
+	t.outboundMut.Lock()
+	defer t.outboundMut.Unlock()
+	t.OutboundRemotes = append(t.OutboundRemotes, r)
+}
+
+//RemoveOutboundRemote reverses AddOutboundRemote
+func (t *Tunnel) RemoveOutboundRemote(r *settings.Remote) {
+	t.outboundMut.Lock()
+	defer t.outboundMut.Unlock()
+	remotes := settings.Remotes{}
+	for _, o := range t.OutboundRemotes {
+		if o.Encode() != r.Encode() {
+			remotes = append(remotes, o)
+		}
+	}
+	t.OutboundRemotes = remotes
+}
+
+//keepAliveLoop pings the connection every KeepAlive interval,
+//closing it once too many consecutive pings fail
+func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn, done <-chan struct{}, dead chan<- struct{}) {
+	maxFailures := t.Config.KeepAliveMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = 1
+	}
+	failures := 0
 	for {
-		time.Sleep(t.Config.KeepAlive)
+		interval, ok := t.waitKeepAlive(done)
+		if !ok {
+			return
+		}
+		timeout := t.Config.KeepAliveTimeout
+		if timeout <= 0 {
+			timeout = interval
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		rtt, err := ping(ctx, sshConn)
+		cancel()
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("no reply within %s", timeout)
+		}
+		t.stats.recordPing(rtt, err)
+		if err == nil {
+			failures = 0
+			atomic.StoreInt64(&t.rtt, int64(rtt))
+			continue
+		}
+		failures++
+		t.Debugf("Keepalive failed (%d/%d): %s", failures, maxFailures, err)
+		if failures >= maxFailures {
+			t.Infof("Keepalive failed, closing connection")
+			dead <- struct{}{}
+			sshConn.Close()
+			return
+		}
+	}
+}
+
+//waitKeepAlive waits for the next keepalive, following
+//any interval changes made while waiting
+func (t *Tunnel) waitKeepAlive(done <-chan struct{}) (time.Duration, bool) {
+	start := time.Now()
+	for {
+		t.keepAliveMut.Lock()
+		interval, changed := t.keepAlive, t.keepAliveChanged
+		t.keepAliveMut.Unlock()
+		var next <-chan time.Time
+		var timer *time.Timer
+		if interval > 0 {
+			timer = time.NewTimer(time.Until(start.Add(interval)))
+			next = timer.C
+		}
+		stop := false
+		select {
+		case <-next:
+			return interval, true
+		case <-changed:
+		case <-done:
+			stop = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stop {
+			return 0, false
+		}
+	}
+}
+
+//SetKeepAlive changes the keepalive interval, taking effect
+//from the pending keepalive, zero disables keepalives
+func (t *Tunnel) SetKeepAlive(d time.Duration) {
+	t.keepAliveMut.Lock()
+	defer t.keepAliveMut.Unlock()
+	t.keepAlive = d
+	close(t.keepAliveChanged)
+	t.keepAliveChanged = make(chan struct{})
+}
+
+//ping sends a single ping, waiting for the reply until ctx is done
+func ping(ctx context.Context, sshConn ssh.Conn) (time.Duration, error) {
+	type result struct {
+		reply []byte
+		err   error
+	}
+	replies := make(chan result, 1)
+	t0 := time.Now()
+	go func() {
 		_, b, err := sshConn.SendRequest("ping", true, nil)
-		if err != nil {
-			break
+		replies <- result{b, err}
+	}()
+	select {
+	case r := <-replies:
+		if r.err != nil {
+			return 0, r.err
 		}
-		if len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
-			t.Debugf("strange ping response")
-			break
+		if len(r.reply) > 0 && !bytes.Equal(r.reply, []byte("pong")) {
+			return 0, errors.New("strange ping response")
 		}
+		return time.Since(t0), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+//Ping measures the round trip time of the current connection,
+//independently of (and without affecting) the keepalives
+func (t *Tunnel) Ping(ctx context.Context) (time.Duration, error) {
+	t.activeConnMut.RLock()
+	c := t.activeConn
+	t.activeConnMut.RUnlock()
+	if c == nil {
+		return 0, errors.New("not connected")
 	}
+	return ping(ctx, c)
+}
+
+//SendRequest sends an SSH global request over the
+//current connection, waiting for its reply
+func (t *Tunnel) SendRequest(name string, payload []byte) (bool, []byte, error) {
+	t.activeConnMut.RLock()
+	c := t.activeConn
+	t.activeConnMut.RUnlock()
+	if c == nil {
+		return false, nil, errors.New("not connected")
+	}
+	return c.SendRequest(name, true, payload)
+}
+
+//Latency is the round trip time of the most recent
+//keepalive, or zero when unknown
+func (t *Tunnel) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
 }
@@ -2,18 +2,37 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/jpillora/chisel/share/cio"
 	"github.com/jpillora/chisel/share/settings"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
 )
 
 //sshTunnel exposes a subset of Tunnel to subtypes
 type sshTunnel interface {
 	getSSH(ctx context.Context) ssh.Conn
+	getSession(ctx context.Context) (ssh.Conn, <-chan struct{})
+	remoteStats(r *settings.Remote, addr string) *remoteStats
+	limit(rwc io.ReadWriteCloser, r *settings.Remote, addr string) io.ReadWriteCloser
+	connLimiter() *connLimiter
+	watchStalls(rwc io.ReadWriteCloser, l *cio.Logger, desc string) io.ReadWriteCloser
+	noDelay(r *settings.Remote) *bool
+	connMiddleware() Middleware
+	channelData(r *settings.Remote, addr string) []byte
+	trackConn(r *settings.Remote, conn net.Conn, closers ...io.Closer) *trackedConn
+	untrackConn(c *trackedConn)
+	profiled(r *settings.Remote, addr string, f func())
+	handleDirect(l *cio.Logger, src io.ReadWriteCloser, remote *settings.Remote) error
 }
 
 //Proxy is the inbound portion of a Tunnel
@@ -21,21 +40,40 @@ type Proxy struct {
 	*cio.Logger
 	sshTun sshTunnel
 	id     int
-	count  int
+	count  int64
 	remote *settings.Remote
+	stats  *remoteStats
 	dialer net.Dialer
-	tcp    *net.TCPListener
+	tcp    net.Listener
 	udp    *udpListener
+	grace  time.Duration
+	//bufferSize of each copy direction
+	bufferSize int
+	//connLimit is the remote's conn-rate
+	connLimit *connLimiter
+	//draining is set while new connections are refused
+	draining int32
+	//port is the bound tcp port, when it differs from the
+	//remote's (see ListenRemotes)
+	port string
 }
 
 //NewProxy creates a Proxy
 func NewProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.Remote) (*Proxy, error) {
+	return newProxy(logger, sshTun, index, remote, "")
+}
+
+func newProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.Remote, port string) (*Proxy, error) {
 	id := index + 1
 	p := &Proxy{
 		Logger: logger.Fork("proxy#%s", remote.String()),
 		sshTun: sshTun,
 		id:     id,
 		remote: remote,
+		stats:  sshTun.remoteStats(remote, ""),
+		//nil when unlimited
+		connLimit: newConnLimiter(remote.ConnRate),
+		port:      port,
 	}
 	return p, p.listen()
 }
@@ -43,44 +81,158 @@ func NewProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.
 func (p *Proxy) listen() error {
 	if p.remote.Stdio {
 		//TODO check if pipes active?
-	} else if p.remote.LocalProto == "tcp" {
-		addr, err := net.ResolveTCPAddr("tcp", p.remote.LocalHost+":"+p.remote.LocalPort)
-		if err != nil {
-			return p.Errorf("resolve: %s", err)
+		return nil
+	}
+	if !p.remote.HasProto("tcp") && !p.remote.HasProto("udp") {
+		return p.Errorf("unknown local proto")
+	}
+	//tcp+udp remotes bind both, on the same port
+	if p.remote.HasProto("tcp") {
+		if err := p.bindTCP(); err != nil {
+			return err
 		}
-		l, err := net.ListenTCP("tcp", addr)
-		if err != nil {
-			return p.Errorf("tcp: %s", err)
+	}
+	if p.remote.HasProto("udp") {
+		r := p.remote
+		if p.port != "" {
+			alt := *r
+			alt.LocalPort = p.port
+			r = &alt
 		}
-		p.Debugf("Listening")
-		p.tcp = l
-	} else if p.remote.LocalProto == "udp" {
-		l, err := listenUDP(p.Logger, p.sshTun, p.remote)
+		l, err := listenUDP(p.Logger, p.sshTun, r)
 		if err != nil {
+			if p.tcp != nil {
+				p.tcp.Close()
+			}
 			return err
 		}
-		p.Debugf("Listening")
+		p.Debugf("Listening (udp)")
 		p.udp = l
-	} else {
-		return p.Errorf("unknown local proto")
 	}
 	return nil
 }
 
+//bindTCP binds a tcp listener per local host
+func (p *Proxy) bindTCP() error {
+	tlsConfig, err := p.remote.ListenTLSConfig()
+	if err != nil {
+		return err
+	}
+	//a listener per local host, all or none are bound
+	listeners := []net.Listener{}
+	for _, local := range p.remote.LocalHosts() {
+		port := p.remote.LocalPort
+		if p.port != "" {
+			port = p.port
+		}
+		l, err := listenTCP(local + ":" + port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return &portInUseError{p.Errorf("%s", err)}
+			}
+			return p.Errorf("%s", err)
+		}
+		if p.port == "0" {
+			//the other hosts share the assigned port
+			_, p.port, _ = net.SplitHostPort(l.Addr().String())
+		}
+		listeners = append(listeners, l)
+	}
+	p.tcp = newMultiListener(listeners)
+	if nd := p.sshTun.noDelay(p.remote); nd != nil {
+		p.tcp = noDelayListener{Listener: p.tcp, noDelay: nd}
+	}
+	if tlsConfig != nil {
+		//terminate tls, forward plaintext
+		p.tcp = tls.NewListener(p.tcp, tlsConfig)
+	}
+	p.Debugf("Listening")
+	return nil
+}
+
+func listenTCP(local string) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", local)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %s", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("tcp: %w", err)
+	}
+	return l, nil
+}
+
+//portInUseError is returned by NewProxy when
+//the remote's tcp port is already bound
+type portInUseError struct {
+	error
+}
+
+//Remote is the proxy's remote
+func (p *Proxy) Remote() *settings.Remote {
+	return p.remote
+}
+
+//Port is the proxy's bound tcp port, which differs from its
+//remote's when it was bound to an alternate port
+func (p *Proxy) Port() string {
+	if p.port != "" {
+		return p.port
+	}
+	return p.remote.LocalPort
+}
+
 //Run enables the proxy and blocks while its active,
 //close the proxy by cancelling the context.
 func (p *Proxy) Run(ctx context.Context) error {
 	defer p.Debugf("Closed")
 	if p.remote.Stdio {
 		return p.runStdio(ctx)
-	} else if p.remote.LocalProto == "tcp" {
+	} else if p.tcp != nil && p.udp != nil {
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.Go(func() error {
+			return p.runTCP(ctx)
+		})
+		eg.Go(func() error {
+			return p.udp.run(ctx)
+		})
+		return eg.Wait()
+	} else if p.tcp != nil {
 		return p.runTCP(ctx)
-	} else if p.remote.LocalProto == "udp" {
+	} else if p.udp != nil {
 		return p.udp.run(ctx)
 	}
 	panic("should not get here")
 }
 
+//SetDraining refuses new tcp connections while draining is set,
+//closing them once accepted, the listener stays bound and open
+//connections are not interrupted
+func (p *Proxy) SetDraining(draining bool) {
+	v := int32(0)
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&p.draining, v)
+}
+
+//Close releases the listener of a proxy which will not be Run
+func (p *Proxy) Close() error {
+	var err error
+	if p.tcp != nil {
+		err = p.tcp.Close()
+	}
+	if p.udp != nil {
+		if uerr := p.udp.inbound.Close(); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
 func (p *Proxy) runStdio(ctx context.Context) error {
 	for {
 		p.pipeRemote(ctx, cio.Stdio)
@@ -94,6 +246,8 @@ func (p *Proxy) runStdio(ctx context.Context) error {
 }
 
 func (p *Proxy) runTCP(ctx context.Context) error {
+	//released on accept errors too, not only on cancel
+	defer p.tcp.Close()
 	done := make(chan struct{})
 	//implements missing net.ListenContext
 	go func() {
@@ -109,35 +263,110 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				//listener closed
+				err = nil
 			default:
 				p.Infof("Accept error: %s", err)
 			}
 			close(done)
 			return err
 		}
-		go p.pipeRemote(ctx, src)
+		if atomic.LoadInt32(&p.draining) == 1 {
+			p.Debugf("Draining, refused connection")
+			src.Close()
+			continue
+		}
+		go func() {
+			if !p.admit(ctx) {
+				p.Debugf("Connection rate exceeded, rejected")
+				src.Close()
+				return
+			}
+			conn := p.sshTun.connMiddleware().apply(p.remote, src)
+			if conn == nil {
+				p.Debugf("Connection dropped by middleware")
+				return
+			}
+			p.pipeRemote(ctx, conn)
+		}()
 	}
 }
 
 func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
 	defer src.Close()
-	p.count++
-	cid := p.count
+	cid := atomic.AddInt64(&p.count, 1)
 	l := p.Fork("conn#%d", cid)
 	l.Debugf("Open")
-	sshConn := p.sshTun.getSSH(ctx)
+	sshConn, lost := p.sshTun.getSession(ctx)
+	if sshConn == nil && p.remote.FallbackDirect && !isDone(ctx) {
+		l.Infof("Tunnel is down, connecting directly to %s (bypassing the tunnel)", p.remote.Remote())
+		if err := p.sshTun.handleDirect(l, src, p.remote); err != nil {
+			l.Infof("Direct connection failed: %s", err)
+		}
+		return
+	}
 	if sshConn == nil {
 		l.Debugf("No remote connection")
 		return
 	}
-	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	dst, err := p.openChannel(sshConn, src)
 	if err != nil {
 		l.Infof("Stream error: %s", err)
 		return
 	}
-	go ssh.DiscardRequests(reqs)
+	//closing both ends unblocks the pipe, and
+	//closes the channel's other end too
+	if d := p.remote.MaxConnLifetime; d > 0 {
+		conn := src
+		expire := time.AfterFunc(d, func() {
+			atomic.AddInt64(&p.stats.expired, 1)
+			l.Infof("Closing, open for longer than the max-lifetime (%s)", d)
+			conn.Close()
+			dst.Close()
+		})
+		defer expire.Stop()
+	}
+	//indexed while open
+	conn, _ := unwrap(src).(net.Conn)
+	tc := p.sshTun.trackConn(p.remote, conn, src, dst)
+	defer p.sshTun.untrackConn(tc)
 	//then pipe
-	s, r := cio.Pipe(src, dst)
+	src = p.sshTun.watchStalls(p.sshTun.limit(src, p.remote, ""), l, "local connection")
+	var s, r int64
+	p.sshTun.profiled(p.remote, "", func() {
+		if p.grace > 0 {
+			b := &bridge{Logger: l, p: p, ctx: ctx, src: src, ch: dst, lost: lost, tc: tc}
+			s, r = b.pipe()
+			return
+		}
+		s, r = cio.PipeWith(src, p.sshTun.watchStalls(dst, l, "tunnel"), cio.PipeOptions{
+			BufferSize: p.bufferSize,
+			Sent: func(n int64) {
+				p.stats.addSent(n)
+				tc.addSent(n)
+			},
+			Received: func(n int64) {
+				p.stats.addReceived(n)
+				tc.addReceived(n)
+			},
+		})
+	})
 	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
 }
+
+//openChannel requests a connection to this proxy's remote,
+//its window and max packet size are fixed by crypto/ssh
+func (p *Proxy) openChannel(sshConn ssh.Conn, src io.ReadWriteCloser) (ssh.Channel, error) {
+	dst, reqs, err := sshConn.OpenChannel("chisel", p.sshTun.channelData(p.remote, p.remote.Remote()))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	//optionally pass the source address to the target
+	if c, ok := unwrap(src).(net.Conn); ok && p.remote.ProxyProtocol {
+		if _, err := dst.Write(proxyHeader(c.RemoteAddr(), c.LocalAddr())); err != nil {
+			dst.Close()
+			return nil, err
+		}
+	}
+	return dst, nil
+}
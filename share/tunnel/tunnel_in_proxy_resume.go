@@ -0,0 +1,267 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//resumeIdle is how long a connection must have been idle
+	//before its last request, for it to be re-bridged
+	resumeIdle = time.Second
+	//resumeMaxPending limits the request bytes kept for replay
+	resumeMaxPending = 64 * 1024
+	//resumeSettle is how long to wait, after a channel error,
+	//for the SSH connection itself to be reported lost
+	resumeSettle = 100 * time.Millisecond
+)
+
+//bridge pipes a local connection to an SSH channel, which may be
+//replaced if the SSH connection is lost (see Config.ReconnectGrace).
+//
+//The target's end of the old channel is closed along with the SSH
+//connection, so a re-bridged connection reaches the target as a new
+//connection. This is only recoverable for request/response protocols
+//which tolerate that between requests, like HTTP keep-alive. So, only
+//connections which were idle for resumeIdle before their latest
+//request are re-bridged, and that request (if its response has not
+//begun) is replayed, so it must be idempotent. Streams, and protocols
+//holding state with the target (TLS, SSH, authenticated sessions),
+//are not recoverable and are closed as usual.
+type bridge struct {
+	*cio.Logger
+	p   *Proxy
+	ctx context.Context
+	src io.ReadWriteCloser
+	tc  *trackedConn
+	//mut guards the fields below, upMut guards writes to the
+	//channel, replacing the channel requires both
+	mut   sync.Mutex
+	upMut sync.Mutex
+	gen   int
+	ch    ssh.Channel
+	lost  <-chan struct{}
+	//resuming is closed once an active rebridge completes
+	resuming chan struct{}
+	failed   bool
+	upDone   bool
+	//last is the time of the last transfer, excluding any pending
+	//request, which is kept until its response arrives
+	last           time.Time
+	pending        []byte
+	sent, received int64
+}
+
+func (b *bridge) pipe() (sent, received int64) {
+	b.last = time.Now()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.up()
+	}()
+	go func() {
+		defer wg.Done()
+		b.down()
+	}()
+	wg.Wait()
+	b.closeAll()
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.sent, b.received
+}
+
+//buffer for a copy direction, sized as Pipe
+func (b *bridge) buffer() []byte {
+	n := b.p.bufferSize
+	if n <= 0 {
+		n = cio.DefaultBufferSize
+	}
+	return make([]byte, n)
+}
+
+//up copies local bytes to the channel,
+//retrying failed writes once re-bridged
+func (b *bridge) up() {
+	buff := b.buffer()
+	for {
+		n, err := b.src.Read(buff)
+		for n > 0 {
+			b.upMut.Lock()
+			gen := b.gen
+			_, werr := b.ch.Write(buff[:n])
+			if werr == nil {
+				b.wrote(buff[:n])
+			}
+			b.upMut.Unlock()
+			if werr != nil {
+				if b.rebridge(gen) {
+					continue
+				}
+				b.closeAll()
+				return
+			}
+			n = 0
+		}
+		if err == io.EOF {
+			//local half-close, no longer recoverable
+			b.upMut.Lock()
+			b.mut.Lock()
+			b.upDone = true
+			b.mut.Unlock()
+			b.ch.CloseWrite()
+			b.upMut.Unlock()
+			return
+		}
+		if err != nil {
+			b.closeAll()
+			return
+		}
+	}
+}
+
+//wrote records sent bytes, upMut must be held
+func (b *bridge) wrote(p []byte) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.sent += int64(len(p))
+	b.p.stats.addSent(int64(len(p)))
+	b.tc.addSent(int64(len(p)))
+	idle := time.Since(b.last) >= resumeIdle
+	if (b.pending != nil || idle) && len(b.pending)+len(p) <= resumeMaxPending {
+		//a new request, retain for replay
+		b.pending = append(b.pending, p...)
+		return
+	}
+	b.pending = nil
+	b.last = time.Now()
+}
+
+//down copies channel bytes to the local connection
+func (b *bridge) down() {
+	buff := b.buffer()
+	for {
+		b.mut.Lock()
+		ch, gen := b.ch, b.gen
+		b.mut.Unlock()
+		n, err := ch.Read(buff)
+		if n > 0 {
+			if _, werr := b.src.Write(buff[:n]); werr != nil {
+				b.closeAll()
+				return
+			}
+			//the response began, the request is complete
+			b.mut.Lock()
+			b.received += int64(n)
+			b.p.stats.addReceived(int64(n))
+			b.tc.addReceived(int64(n))
+			b.pending = nil
+			b.last = time.Now()
+			b.mut.Unlock()
+		}
+		if err == nil {
+			continue
+		}
+		if b.rebridge(gen) {
+			continue
+		}
+		//target finished, half-close if possible
+		if cw, ok := b.src.(interface{ CloseWrite() error }); ok && err == io.EOF {
+			cw.CloseWrite()
+			return
+		}
+		b.closeAll()
+		return
+	}
+}
+
+//rebridge replaces channel generation gen, after its SSH connection
+//was lost, reporting false when the connection should close instead
+func (b *bridge) rebridge(gen int) bool {
+	b.mut.Lock()
+	if wait := b.resuming; wait != nil && b.gen == gen {
+		//the other direction is re-bridging
+		b.mut.Unlock()
+		<-wait
+		b.mut.Lock()
+	}
+	if b.gen != gen || b.failed {
+		//already replaced, or closing
+		defer b.mut.Unlock()
+		return !b.failed
+	}
+	if b.upDone || (b.pending == nil && time.Since(b.last) < resumeIdle) {
+		b.failed = true
+		b.mut.Unlock()
+		return false
+	}
+	done := make(chan struct{})
+	b.resuming = done
+	b.mut.Unlock()
+	ok := b.resume()
+	b.mut.Lock()
+	b.resuming = nil
+	if !ok {
+		b.failed = true
+	}
+	b.mut.Unlock()
+	close(done)
+	return ok
+}
+
+//resume waits for the next SSH connection,
+//then replaces the channel and replays the request
+func (b *bridge) resume() bool {
+	select {
+	case <-b.lost:
+	case <-time.After(resumeSettle):
+		//still connected, the target closed the channel
+		return false
+	}
+	b.Debugf("SSH connection lost, waiting up to %s to re-bridge", b.p.grace)
+	ctx, cancel := context.WithTimeout(b.ctx, b.p.grace)
+	defer cancel()
+	sshConn, lost := b.p.sshTun.getSession(ctx)
+	if sshConn == nil {
+		b.Debugf("Reconnect grace period expired")
+		return false
+	}
+	ch, err := b.p.openChannel(sshConn, b.src)
+	if err != nil {
+		b.Debugf("Re-bridge failed: %s", err)
+		return false
+	}
+	b.upMut.Lock()
+	defer b.upMut.Unlock()
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.failed {
+		//closed meanwhile
+		ch.Close()
+		return false
+	}
+	if len(b.pending) > 0 {
+		if _, err := ch.Write(b.pending); err != nil {
+			ch.Close()
+			return false
+		}
+	}
+	b.ch.Close()
+	b.ch, b.lost = ch, lost
+	b.gen++
+	b.Debugf("Re-bridged")
+	return true
+}
+
+func (b *bridge) closeAll() {
+	b.src.Close()
+	b.mut.Lock()
+	b.failed = true
+	b.ch.Close()
+	b.mut.Unlock()
+}
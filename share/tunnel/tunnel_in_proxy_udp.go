@@ -44,6 +44,7 @@ func listenUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*udpLi
 		sshTun:  sshTun,
 		remote:  remote,
 		inbound: conn,
+		stats:   sshTun.remoteStats(remote, ""),
 	}
 	return u, nil
 }
@@ -56,9 +57,11 @@ type udpListener struct {
 	outboundMut sync.Mutex
 	outbound    *udpChannel
 	sent, recv  int64
+	stats       *remoteStats
 }
 
 func (u *udpListener) run(ctx context.Context) error {
+	defer u.inbound.Close()
 	//udp doesnt accept connections,
 	//udp simply forwards packets
 	//and therefore only needs to listen
@@ -108,6 +111,7 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 		}
 		//stats
 		atomic.AddInt64(&u.sent, int64(n))
+		u.stats.addTraffic(int64(n), 0, int64(n), 0)
 	}
 	return nil
 }
@@ -141,6 +145,7 @@ func (u *udpListener) runOutbound(ctx context.Context) error {
 		}
 		//stats
 		atomic.AddInt64(&u.recv, int64(n))
+		u.stats.addTraffic(0, int64(n), 0, int64(n))
 	}
 	return nil
 }
@@ -160,7 +165,7 @@ func (u *udpListener) getUDPChan(ctx context.Context) (*udpChannel, error) {
 	//ssh request for udp packets for this proxy's remote,
 	//just "udp" since the remote address is sent with each packet
 	dstAddr := u.remote.Remote() + "/udp"
-	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte(dstAddr))
+	rwc, reqs, err := sshConn.OpenChannel("chisel", u.sshTun.channelData(u.remote, dstAddr))
 	if err != nil {
 		return nil, fmt.Errorf("ssh-chan error: %s", err)
 	}
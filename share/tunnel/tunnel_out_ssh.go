@@ -1,13 +1,17 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/chisel/share/cio"
-	"github.com/jpillora/chisel/share/cnet"
 	"github.com/jpillora/chisel/share/settings"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -19,7 +23,13 @@ func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request) {
 		case "ping":
 			r.Reply(true, []byte("pong"))
 		default:
+			if h, ok := t.Config.RequestHandlers[r.Type]; ok {
+				r.Reply(h(r.Payload))
+				continue
+			}
 			t.Debugf("Unknown request: %s", r.Type)
+			//reject, the sender may be waiting on a reply
+			r.Reply(false, nil)
 		}
 	}
 }
@@ -36,12 +46,13 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 		ch.Reject(ssh.Prohibited, "Denied outbound connection")
 		return
 	}
-	remote := string(ch.ExtraData())
+	addr, id := parseChannelData(ch.ExtraData())
+	remote := t.outboundRemote(addr, id)
 	//extract protocol
-	hostPort, proto := settings.L4Proto(remote)
+	hostPort, proto := settings.L4Proto(addr)
 	udp := proto == "udp"
 	socks := hostPort == "socks"
-	if socks && t.socksServer == nil {
+	if socks && t.socksConfig == nil {
 		t.Debugf("Denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
 		return
@@ -59,11 +70,11 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	t.connStats.Open()
 	l.Debugf("Open %s", t.connStats.String())
 	if socks {
-		err = t.handleSocks(stream)
+		err = t.handleSocks(stream, remote)
 	} else if udp {
-		err = t.handleUDP(l, stream, hostPort)
+		err = t.handleUDP(l, stream, hostPort, remote)
 	} else {
-		err = t.handleTCP(l, stream, hostPort)
+		err = t.handleTCP(l, stream, hostPort, remote, nil)
 	}
 	t.connStats.Close()
 	errmsg := ""
@@ -73,16 +84,229 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	l.Debugf("Close %s%s", t.connStats.String(), errmsg)
 }
 
-func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
-	return t.socksServer.ServeConn(cnet.NewRWCConn(src))
-}
-
-func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string) error {
-	dst, err := net.Dial("tcp", hostPort)
+//handleTCP dials the remote's target with dial (nil
+//dials directly) and pipes src to it
+func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string, remote *settings.Remote, dial dialFunc) error {
+	ctx := context.Background()
+	timeout := t.Config.DialTimeout
+	if remote != nil && remote.DialTimeout > 0 {
+		timeout = remote.DialTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	//a pool fails over to its next target
+	targets := t.targets(remote, hostPort)
+	pooled := len(targets) > 1 || targets[0] != hostPort
+	dst, hostPort, picked, err := t.dialTargets(ctx, l, remote, targets, dial)
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddInt64(&t.stats.dialTimeouts, 1)
+			l.Infof("Dial %s timed out after %s", hostPort, timeout)
+		}
 		return err
 	}
-	s, r := cio.Pipe(src, dst)
+	spec := hostPort
+	if remote != nil {
+		spec = remote.String()
+	}
+	setNoDelay(dst, t.noDelay(remote))
+	if remote != nil && remote.TLSOrigin {
+		serverName := ""
+		if pooled {
+			serverName, _, _ = net.SplitHostPort(picked)
+		}
+		if dst, err = t.originateTLS(ctx, dst, remote, serverName); err != nil {
+			l.Infof("TLS to %s failed: %s", hostPort, err)
+			return err
+		}
+	}
+	if dst = t.Config.DialMiddleware.apply(remote, dst); dst == nil {
+		l.Debugf("Connection to %s dropped by middleware", hostPort)
+		return nil
+	}
+	stats := t.remoteStats(remote, hostPort)
+	if pooled {
+		stats.addTarget(picked)
+	}
+	tc := t.trackConn(remote, dst, src, dst)
+	defer t.untrackConn(tc)
+	tun := t.watchStalls(src, l, "tunnel ("+spec+")")
+	target := t.watchStalls(t.limit(dst, remote, hostPort), l, "target ("+spec+")")
+	var s, r int64
+	t.profiled(remote, hostPort, func() {
+		s, r = cio.PipeWith(tun, target, cio.PipeOptions{
+			BufferSize: t.Config.CopyBufferSize,
+			Sent: func(n int64) {
+				stats.addSent(n)
+				tc.addSent(n)
+			},
+			Received: func(n int64) {
+				stats.addReceived(n)
+				tc.addReceived(n)
+			},
+		})
+	})
 	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
 	return nil
 }
+
+//maxDialBackoff caps the doubling of a remote's DialBackoff
+const maxDialBackoff = 10 * time.Second
+
+//dialTargets dials the targets in turn until one connects, retrying
+//them the remote's DialRetries times, returning the address dialed
+//and the target picked
+func (t *Tunnel) dialTargets(ctx context.Context, l *cio.Logger, remote *settings.Remote, targets []string, dial dialFunc) (net.Conn, string, string, error) {
+	retries, backoff := 0, time.Duration(0)
+	if remote != nil {
+		retries, backoff = remote.DialRetries, remote.DialBackoff
+	}
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		var dst net.Conn
+		var hostPort string
+		var err error
+		for i, picked := range targets {
+			if dst, hostPort, err = t.dialTarget(ctx, l, remote, picked, dial); err == nil || ctx.Err() != nil {
+				return dst, hostPort, picked, err
+			}
+			if i < len(targets)-1 {
+				l.Debugf("Dial %s failed (%s), trying %s", hostPort, err, targets[i+1])
+			}
+		}
+		if _, refused := err.(refusedError); refused || attempt == retries {
+			return nil, hostPort, targets[len(targets)-1], err
+		}
+		l.Debugf("Dial %s failed (%s), retrying in %s", hostPort, err, backoff)
+		atomic.AddInt64(&t.stats.dialRetries, 1)
+		atomic.AddInt64(&t.remoteStats(remote, targets[0]).dialRetries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, hostPort, targets[len(targets)-1], ctx.Err()
+		}
+		if backoff *= 2; backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
+
+//handleDirect pipes src to the remote's target, dialed
+//with the DirectDial rather than through the tunnel
+func (t *Tunnel) handleDirect(l *cio.Logger, src io.ReadWriteCloser, remote *settings.Remote) error {
+	return t.handleTCP(l, src, remote.Remote(), remote, t.Config.DirectDial)
+}
+
+//dialFunc dials network connections, as net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+//dialTarget dials a target of the remote, after the DialFilter,
+//returning the address dialed
+func (t *Tunnel) dialTarget(ctx context.Context, l *cio.Logger, remote *settings.Remote, target string, dial dialFunc) (net.Conn, string, error) {
+	hostPort, err := t.filterDial(ctx, l, remote, "tcp", target)
+	if err != nil {
+		return nil, target, refusedError{err}
+	}
+	spec := hostPort
+	if remote != nil {
+		spec = remote.String()
+	}
+	if dial == nil {
+		d := net.Dialer{}
+		dial = d.DialContext
+	}
+	t0 := time.Now()
+	dst, err := dial(ctx, "tcp", hostPort)
+	t.logSlowDial(l, hostPort, spec, time.Since(t0))
+	return dst, hostPort, err
+}
+
+//refusedError is a dial refused by the DialFilter, it isn't retried
+type refusedError struct {
+	error
+}
+
+func (e refusedError) Unwrap() error {
+	return e.error
+}
+
+//filterDial applies the DialFilter to addr, logging refusals
+func (t *Tunnel) filterDial(ctx context.Context, l *cio.Logger, remote *settings.Remote, network, addr string) (string, error) {
+	f := t.Config.DialFilter
+	if f == nil {
+		return addr, nil
+	}
+	r := settings.Remote{}
+	if remote != nil {
+		r = *remote
+	}
+	filtered, err := f(ctx, r, network, addr)
+	if err != nil {
+		l.Infof("Dial %s/%s refused: %s", addr, network, err)
+		return "", err
+	}
+	if filtered != addr {
+		l.Debugf("Dial %s/%s redirected to %s", addr, network, filtered)
+	}
+	return filtered, nil
+}
+
+//dialSocks dials SOCKS5 connections
+func (t *Tunnel) dialSocks(ctx context.Context, remote *settings.Remote, network, addr string) (net.Conn, error) {
+	addr, err := t.filterDial(ctx, t.Logger, remote, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	setNoDelay(conn, t.noDelay(remote))
+	if conn = t.Config.DialMiddleware.apply(remote, conn); conn == nil {
+		return nil, errors.New("dropped by middleware")
+	}
+	return conn, nil
+}
+
+//originateTLS wraps dst in a TLS client, configs are loaded
+//once per remote and shared by its subsequent connections,
+//a serverName (of a pool's target) overrides the remote host
+func (t *Tunnel) originateTLS(ctx context.Context, dst net.Conn, remote *settings.Remote, serverName string) (net.Conn, error) {
+	key := remote.String()
+	t.tlsMut.Lock()
+	c, ok := t.dialTLS[key]
+	if !ok {
+		var err error
+		c, err = remote.DialTLSConfig()
+		if err != nil {
+			t.tlsMut.Unlock()
+			dst.Close()
+			return nil, err
+		}
+		if t.dialTLS == nil {
+			t.dialTLS = map[string]*tls.Config{}
+		}
+		t.dialTLS[key] = c
+	}
+	t.tlsMut.Unlock()
+	if serverName != "" {
+		c = c.Clone()
+		c.ServerName = serverName
+	}
+	conn := tls.Client(dst, c)
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/gob"
 	"io"
 	"net"
@@ -9,9 +10,14 @@ import (
 	"time"
 
 	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
 )
 
-func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort string) error {
+func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort string, remote *settings.Remote) error {
+	hostPort, err := t.filterDial(context.Background(), l, remote, "udp", hostPort)
+	if err != nil {
+		return err
+	}
 	h := &udpHandler{
 		Logger:   l,
 		hostPort: hostPort,
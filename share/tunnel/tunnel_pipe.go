@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jpillora/chisel/share/ccrypto"
+	"github.com/jpillora/chisel/share/cnet"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+//ConnectPipe connects a client and server Tunnel over a
+//cnet.MemPipe, with an SSH connection but no sockets (nor chisel's
+//auth and config handshake), for tests of the tunnels and their
+//remotes. It returns once both are bound (see BindSSH), and wait
+//blocks until ctx is cancelled or either side's connection closes.
+func ConnectPipe(ctx context.Context, client, server *Tunnel) (wait func() error, err error) {
+	key, err := ccrypto.GenerateKey("")
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	clientConfig := &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	//handshake both ends at once
+	c, s := cnet.MemPipe()
+	type handshake struct {
+		conn  ssh.Conn
+		chans <-chan ssh.NewChannel
+		reqs  <-chan *ssh.Request
+		err   error
+	}
+	accepted := make(chan handshake, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(s, serverConfig)
+		accepted <- handshake{conn, chans, reqs, err}
+	}()
+	cconn, cchans, creqs, err := ssh.NewClientConn(c, "pipe", clientConfig)
+	if err != nil {
+		s.Close()
+		<-accepted
+		return nil, err
+	}
+	h := <-accepted
+	if h.err != nil {
+		cconn.Close()
+		return nil, h.err
+	}
+	eg, bctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return client.BindSSH(bctx, cconn, creqs, cchans)
+	})
+	eg.Go(func() error {
+		return server.BindSSH(bctx, h.conn, h.reqs, h.chans)
+	})
+	for _, t := range []*Tunnel{client, server} {
+		if t.getSSH(bctx) == nil {
+			if err := eg.Wait(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("pipe closed")
+		}
+		//waiting isn't a demand for a connection
+		t.ClearDemand()
+	}
+	return eg.Wait, nil
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import "io"
+
+//halfCloser re-exposes the CloseWrite of a wrapped ReadWriteCloser
+type halfCloser struct {
+	io.ReadWriteCloser
+	cw interface{ CloseWrite() error }
+}
+
+func (h halfCloser) CloseWrite() error {
+	return h.cw.CloseWrite()
+}
+
+//withCloseWrite returns wrapper, along with the CloseWrite
+//support of the inner ReadWriteCloser which it wraps
+func withCloseWrite(inner, wrapper io.ReadWriteCloser) io.ReadWriteCloser {
+	if cw, ok := inner.(interface{ CloseWrite() error }); ok {
+		return halfCloser{ReadWriteCloser: wrapper, cw: cw}
+	}
+	return wrapper
+}
+
+//unwrap returns the ReadWriteCloser beneath any wrappers
+func unwrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	for {
+		switch r := rwc.(type) {
+		case halfCloser:
+			rwc = r.ReadWriteCloser
+		case *limitedRWC:
+			rwc = r.ReadWriteCloser
+		case *stallRWC:
+			rwc = r.ReadWriteCloser
+		default:
+			return rwc
+		}
+	}
+}
@@ -2,6 +2,7 @@ package e2e_test
 
 import (
 	"testing"
+	"time"
 
 	chclient "github.com/jpillora/chisel/client"
 	chserver "github.com/jpillora/chisel/server"
@@ -46,3 +47,31 @@ func TestAuth(t *testing.T) {
 		t.Fatalf("expected exclamation mark added again")
 	}
 }
+
+func TestOnAuthenticated(t *testing.T) {
+	infos := make(chan chclient.AuthInfo, 1)
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			KeySeed: "foobar",
+			Auth:    "foo:bar",
+		},
+		&chclient.Config{
+			Remotes: []string{availablePort() + ":$FILEPORT"},
+			Auth:    "foo:bar",
+			OnAuthenticated: func(info chclient.AuthInfo) {
+				infos <- info
+			},
+		})
+	defer teardown()
+	select {
+	case info := <-infos:
+		if info.User != "foo" {
+			t.Fatalf("expected user foo, got %s", info.User)
+		}
+		if info.Fingerprint == "" || info.Time.IsZero() {
+			t.Fatalf("expected fingerprint and time, got %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected OnAuthenticated to be called")
+	}
+}
@@ -0,0 +1,83 @@
+package e2e_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestBandwidthWeights(t *testing.T) {
+	//endpoint discards everything it receives
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	light, heavy := availablePort(), availablePort()
+	remotes := []string{
+		light + ":127.0.0.1:" + endPort,
+		"weight=3:" + heavy + ":127.0.0.1:" + endPort,
+	}
+	const limit = 400 * 1000
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{Remotes: remotes, MaxBandwidth: limit},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	//both remotes upload as fast as they can
+	done := make(chan struct{})
+	defer close(done)
+	for _, port := range []string{light, heavy} {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func(c net.Conn) {
+			b := make([]byte, 32*1024)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := c.Write(b); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+	//let the throughput averages settle
+	time.Sleep(1500 * time.Millisecond)
+	rates := map[string]float64{}
+	for k, r := range client.Stats().Remotes {
+		for _, port := range []string{light, heavy} {
+			if strings.HasPrefix(k, port+"=>") {
+				rates[port] = r.Throughput
+			}
+		}
+	}
+	if total := rates[light] + rates[heavy]; total > limit*1.25 || total < limit*0.5 {
+		t.Fatalf("expected a total near %d B/s, got %.0f (%v)", limit, total, rates)
+	}
+	if ratio := rates[heavy] / rates[light]; ratio < 2 || ratio > 4 {
+		t.Fatalf("expected the weighted remote to get ~3x, got %.2fx (%v)", ratio, rates)
+	}
+}
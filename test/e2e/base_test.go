@@ -1,7 +1,10 @@
 package e2e_test
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	chclient "github.com/jpillora/chisel/client"
 	chserver "github.com/jpillora/chisel/server"
@@ -26,6 +29,29 @@ func TestBase(t *testing.T) {
 	}
 }
 
+func TestNoDelay(t *testing.T) {
+	tmpPort, revPort := availablePort(), availablePort()
+	enabled := true
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true, NoDelay: &enabled},
+		&chclient.Config{
+			Remotes: []string{
+				"nodelay=false:" + tmpPort + ":$FILEPORT",
+				"R:nodelay=false:" + revPort + ":$FILEPORT",
+			},
+		})
+	defer teardown()
+	for _, port := range []string{tmpPort, revPort} {
+		result, err := post("http://localhost:"+port, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
+
 func TestReverse(t *testing.T) {
 	tmpPort := availablePort()
 	//setup server, client, fileserver
@@ -46,3 +72,102 @@ func TestReverse(t *testing.T) {
 		t.Fatalf("expected exclamation mark added")
 	}
 }
+
+func TestMaxMessageSize(t *testing.T) {
+	//too small for an SSH packet
+	if _, err := chclient.NewClient(&chclient.Config{Server: "localhost:1", MaxMessageSize: 4096}); err == nil {
+		t.Fatal("expected MaxMessageSize below an SSH packet to be rejected")
+	}
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{
+			RequestHandlers: map[string]func([]byte) (bool, []byte){
+				"big": func([]byte) (bool, []byte) {
+					return true, make([]byte, 64*1024)
+				},
+			},
+		},
+		client: &chclient.Config{
+			Remotes:        []string{tmpPort + ":$FILEPORT"},
+			MaxMessageSize: 48 * 1024,
+			MaxRetryCount:  -1,
+			LogBufferSize:  100,
+		},
+		fileServer: true,
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	//channel data fits
+	if result, err := post("http://localhost:"+tmpPort, strings.Repeat("x", 64*1024)); err != nil || len(result) != 64*1024+1 {
+		t.Fatalf("expected the large echo to succeed, got %d bytes (%v)", len(result), err)
+	}
+	//the reply exceeds the limit
+	if _, _, err := client.SendRequest("big", nil); err == nil {
+		t.Fatal("expected oversized reply to fail")
+	}
+	for i := 0; i < 100 && !strings.Contains(strings.Join(client.RecentLogs(100), "\n"), "larger than MaxMessageSize"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logs := strings.Join(client.RecentLogs(100), "\n"); !strings.Contains(logs, "server sent a message larger than MaxMessageSize") {
+		t.Fatalf("expected the read limit error, got %s", logs)
+	}
+	//and the client reconnects
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	for i := 0; i < 100 && err != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result, err = post("http://localhost:"+tmpPort, "foo")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestPing(t *testing.T) {
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	rtt, err := client.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected positive rtt, got %s", rtt)
+	}
+	//disconnected clients fail
+	client.Close()
+	client.Wait()
+	if _, err := client.Ping(context.Background()); err == nil {
+		t.Fatal("expected ping to fail once closed")
+	}
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	//no keepalives until enabled
+	time.Sleep(50 * time.Millisecond)
+	if n := client.Stats().Pings; n != 0 {
+		t.Fatalf("expected no keepalives, got %d", n)
+	}
+	client.SetKeepAlive(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	client.SetKeepAlive(0)
+	n := client.Stats().Pings
+	if n < 3 {
+		t.Fatalf("expected keepalives once enabled, got %d", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m := client.Stats().Pings; m > n+1 {
+		t.Fatalf("expected keepalives to stop, got %d more", m-n)
+	}
+}
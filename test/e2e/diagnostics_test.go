@@ -0,0 +1,107 @@
+package e2e_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestStallLogging(t *testing.T) {
+	//endpoint accepts, but never reads
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true},
+		client: &chclient.Config{
+			Remotes:           []string{"R:" + tmpPort + ":127.0.0.1:" + endPort},
+			LogBufferSize:     100,
+			SlowDialThreshold: time.Nanosecond,
+			StallThreshold:    50 * time.Millisecond,
+		},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//fill the endpoint's buffers
+	go conn.Write(make([]byte, 32*1024*1024))
+	time.Sleep(500 * time.Millisecond)
+	logs := strings.Join(client.RecentLogs(100), "\n")
+	if !strings.Contains(logs, "Slow dial to 127.0.0.1:"+endPort) {
+		t.Fatalf("expected a slow dial log, got:\n%s", logs)
+	}
+	if !strings.Contains(logs, "Write to target (R:"+tmpPort+"=>"+endPort+") stalled") {
+		t.Fatalf("expected a stall log, got:\n%s", logs)
+	}
+}
+
+func TestProfileLabels(t *testing.T) {
+	//endpoint holds connections open
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{
+			Remotes:       []string{tmpPort + ":127.0.0.1:" + endPort},
+			ProfileLabels: true,
+		},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(client.Connections()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	label := `"remote":"` + tmpPort + "=>" + endPort + `"`
+	if !strings.Contains(buf.String(), label) {
+		t.Fatalf("expected a goroutine labelled %s, got:\n%s", label, buf.String())
+	}
+}
@@ -0,0 +1,158 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/settings"
+	"golang.org/x/net/proxy"
+)
+
+func TestDialFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+	redirectPort, blockPort, socksPort := availablePort(), availablePort(), availablePort()
+	mut := sync.Mutex{}
+	filtered := map[string]string{}
+	filter := func(ctx context.Context, r settings.Remote, network, addr string) (string, error) {
+		mut.Lock()
+		filtered[addr] = r.String()
+		mut.Unlock()
+		switch {
+		case r.LocalPort == blockPort:
+			return "", errors.New("blocked")
+		case addr == "127.0.0.1:1":
+			return backendAddr, nil
+		}
+		return addr, nil
+	}
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true, DialFilter: filter},
+		&chclient.Config{Remotes: []string{
+			redirectPort + ":127.0.0.1:1",
+			blockPort + ":" + backendAddr,
+			socksPort + ":socks",
+		}})
+	defer teardown()
+	//forward, redirected
+	if result, err := post("http://localhost:"+redirectPort, "foo"); err != nil || result != "backend" {
+		t.Fatalf("expected redirect to the backend, got %q (%v)", result, err)
+	}
+	//forward, blocked
+	if _, err := post("http://localhost:"+blockPort, "foo"); err == nil {
+		t.Fatal("expected the blocked remote to fail")
+	}
+	//socks, redirected
+	dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:"+socksPort, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Transport: &http.Transport{
+		Dial: dialer.Dial,
+	}}
+	resp, err := client.Get("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mut.Lock()
+	defer mut.Unlock()
+	if r := filtered["127.0.0.1:1"]; !strings.Contains(r, "socks") {
+		t.Fatalf("expected the socks remote, got %q", r)
+	}
+	if _, ok := filtered[backendAddr]; !ok {
+		t.Fatal("expected the blocked dial to be filtered")
+	}
+}
+
+func TestDialFilterSharedTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+	blockPort, allowPort := availablePort(), availablePort()
+	revBlockPort, revAllowPort := availablePort(), availablePort()
+	//remotes sharing a target are still told apart
+	filter := func(ctx context.Context, r settings.Remote, network, addr string) (string, error) {
+		if r.LocalPort == blockPort || r.LocalPort == revBlockPort {
+			return "", errors.New("blocked")
+		}
+		return addr, nil
+	}
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true, DialFilter: filter},
+		&chclient.Config{
+			DialFilter: filter,
+			Remotes: []string{
+				blockPort + ":" + backendAddr,
+				allowPort + ":" + backendAddr,
+				"R:" + revBlockPort + ":" + backendAddr,
+				"R:" + revAllowPort + ":" + backendAddr,
+			},
+		})
+	defer teardown()
+	for _, port := range []string{allowPort, revAllowPort} {
+		if result, err := post("http://localhost:"+port, "foo"); err != nil || result != "backend" {
+			t.Fatalf("expected the backend on %s, got %q (%v)", port, result, err)
+		}
+	}
+	for _, port := range []string{blockPort, revBlockPort} {
+		if _, err := post("http://localhost:"+port, "foo"); err == nil {
+			t.Fatalf("expected %s to be blocked", port)
+		}
+	}
+}
+
+func TestDialFilterSocksHostname(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+	socksPort := availablePort()
+	//names are filtered before they're resolved
+	filter := func(ctx context.Context, r settings.Remote, network, addr string) (string, error) {
+		switch addr {
+		case "blocked.invalid:80":
+			return "", errors.New("blocked")
+		case "backend.invalid:80":
+			return backendAddr, nil
+		}
+		return "", errors.New("unexpected " + addr)
+	}
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true, DialFilter: filter},
+		&chclient.Config{Remotes: []string{socksPort + ":socks"}})
+	defer teardown()
+	dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:"+socksPort, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Transport: &http.Transport{
+		Dial: dialer.Dial,
+	}}
+	resp, err := client.Get("http://backend.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "backend" {
+		t.Fatalf("expected the backend, got %q", b)
+	}
+	if _, err := client.Get("http://blocked.invalid"); err == nil {
+		t.Fatal("expected the blocked name to fail")
+	}
+}
@@ -0,0 +1,53 @@
+package e2e_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestHalfClose(t *testing.T) {
+	//endpoint reads the full request, then responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		c.Write(append(b, '!'))
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":" + endPort},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	//signal the end of the request, keep reading
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "foo!" {
+		t.Fatalf("expected 'foo!', got '%s'", b)
+	}
+}
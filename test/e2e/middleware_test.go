@@ -0,0 +1,58 @@
+package e2e_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//countingConn counts the bytes read
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestConnMiddleware(t *testing.T) {
+	allowPort, dropPort := availablePort(), availablePort()
+	accepted, dialed := int64(0), int64(0)
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			DialMiddleware: func(r settings.Remote, c net.Conn) net.Conn {
+				return countingConn{c, &dialed}
+			},
+		},
+		&chclient.Config{
+			Remotes: []string{allowPort + ":$FILEPORT", dropPort + ":$FILEPORT"},
+			ConnMiddleware: func(r settings.Remote, c net.Conn) net.Conn {
+				if r.LocalPort == dropPort {
+					return nil
+				}
+				return countingConn{c, &accepted}
+			},
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+allowPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	//the request and response passed through the middleware
+	if atomic.LoadInt64(&accepted) == 0 || atomic.LoadInt64(&dialed) == 0 {
+		t.Fatalf("expected both middlewares to see traffic, got %d and %d", accepted, dialed)
+	}
+	if _, err := post("http://localhost:"+dropPort, "foo"); err == nil {
+		t.Fatal("expected the connection to be dropped")
+	}
+}
@@ -0,0 +1,114 @@
+package e2e_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+func TestConnectPipe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append(b, '!'))
+	}))
+	defer fileServer.Close()
+	//tunnels over an in-memory ssh connection
+	client := tunnel.New(tunnel.Config{Logger: cio.NewLogger("client"), Inbound: true})
+	server := tunnel.New(tunnel.Config{Logger: cio.NewLogger("server"), Outbound: true})
+	wait, err := tunnel.ConnectPipe(ctx, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tmpPort := availablePort()
+	r, err := settings.DecodeRemote(tmpPort + ":" + strings.TrimPrefix(fileServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound := make(chan error, 1)
+	go func() {
+		unbound <- client.BindRemotes(ctx, []*settings.Remote{r})
+	}()
+	var result string
+	for i := 0; i < 100; i++ {
+		if result, err = post("http://127.0.0.1:"+tmpPort, "foo"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added, got %q", result)
+	}
+	//cancelling unbinds the remotes and closes the pipe
+	cancel()
+	if err := <-unbound; err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	if _, err := client.Ping(context.Background()); err == nil {
+		t.Fatal("expected the pipe to be closed")
+	}
+}
+
+func TestBindRemotesCancel(t *testing.T) {
+	tun := tunnel.New(tunnel.Config{Logger: cio.NewLogger("client"), Inbound: true})
+	for _, delay := range []time.Duration{0, time.Millisecond, 100 * time.Millisecond} {
+		//many remotes, so cancelling tends to land mid-bind
+		var ports []string
+		var remotes []*settings.Remote
+		picked := map[string]bool{}
+		for len(ports) < 20 {
+			//a freed port may be picked again
+			port := availablePort()
+			if picked[port] {
+				continue
+			}
+			picked[port] = true
+			r, err := settings.DecodeRemote("127.0.0.1:" + port + ":127.0.0.1:1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports = append(ports, port)
+			remotes = append(remotes, r)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		unbound := make(chan error, 1)
+		go func() {
+			unbound <- tun.BindRemotes(ctx, remotes)
+		}()
+		time.Sleep(delay)
+		cancel()
+		select {
+		case err := <-unbound:
+			if err != nil {
+				t.Fatalf("%s: %s", delay, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expected BindRemotes to return once cancelled", delay)
+		}
+		//every listener was closed
+		for _, port := range ports {
+			l, err := net.Listen("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				t.Fatalf("%s: expected port %s to be released: %s", delay, port, err)
+			}
+			l.Close()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package e2e_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestReverseProxyProtocol(t *testing.T) {
+	//endpoint reports the first line it reads
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- line
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"R:proxy-protocol=true:" + tmpPort + ":127.0.0.1:" + endPort},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src := conn.LocalAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %s\r\n", src.Port, tmpPort)
+	if line := <-lines; line != expected {
+		t.Fatalf("expected header %q, got %q", expected, line)
+	}
+}
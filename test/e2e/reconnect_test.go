@@ -0,0 +1,389 @@
+package e2e_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+//connectProxy is an HTTP CONNECT proxy whose tunnels can
+//be severed or stalled to simulate network loss
+type connectProxy struct {
+	net.Listener
+	mut     sync.Mutex
+	conns   []net.Conn
+	blocked bool
+	stalled bool
+}
+
+func newConnectProxy(t *testing.T) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{Listener: l}
+	go func() {
+		for {
+			src, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(src)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) handle(src net.Conn) {
+	defer src.Close()
+	req, err := http.ReadRequest(bufio.NewReader(src))
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	dst, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	p.mut.Lock()
+	if p.blocked {
+		p.mut.Unlock()
+		return
+	}
+	p.conns = append(p.conns, src, dst)
+	p.mut.Unlock()
+	src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(stallWriter{p, dst}, src)
+	io.Copy(stallWriter{p, src}, dst)
+}
+
+//stallWriter drops writes while its proxy is stalled
+type stallWriter struct {
+	p *connectProxy
+	io.Writer
+}
+
+func (s stallWriter) Write(b []byte) (int, error) {
+	s.p.mut.Lock()
+	stalled := s.p.stalled
+	s.p.mut.Unlock()
+	if stalled {
+		return len(b), nil
+	}
+	return s.Writer.Write(b)
+}
+
+//stall tunnels, dropping their traffic without closing them
+func (p *connectProxy) stall(stalled bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.stalled = stalled
+}
+
+func (p *connectProxy) sever() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+//block new tunnels, so reconnects fail
+func (p *connectProxy) block(blocked bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.blocked = blocked
+}
+
+func TestReconnectGrace(t *testing.T) {
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Proxy:          "http://" + proxy.Addr().String(),
+			Remotes:        []string{tmpPort + ":$FILEPORT"},
+			ReconnectGrace: 5 * time.Second,
+			MaxRetryCount:  -1,
+		})
+	defer teardown()
+	//keep-alive client, reporting connection reuse
+	client := http.Client{Transport: &http.Transport{}}
+	reused := false
+	send := func(body string) string {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:"+tmpPort, strings.NewReader(body))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+	if result := send("foo"); result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	//idle, then lose the server connection
+	time.Sleep(1200 * time.Millisecond)
+	proxy.sever()
+	//the idle connection survives the reconnect
+	if result := send("bar"); result != "bar!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	if !reused {
+		t.Fatal("expected the local connection to be reused")
+	}
+}
+
+func TestReconnectWait(t *testing.T) {
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{
+			Proxy:            "http://" + proxy.Addr().String(),
+			Remotes:          []string{tmpPort + ":$FILEPORT"},
+			ReconnectWait:    300 * time.Millisecond,
+			MaxRetryCount:    -1,
+			MaxRetryInterval: time.Second,
+		},
+		fileServer: true,
+	}
+	_, c, teardown := tl.setup(t)
+	defer teardown()
+	send := func() error {
+		//new connection per request
+		client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Post("http://127.0.0.1:"+tmpPort, "text/plain", strings.NewReader("foo"))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	//lose the server, the listener stays up while
+	//connections wait, then they're closed
+	proxy.block(true)
+	proxy.sever()
+	for i := 0; i < 100 && !c.ConnectedSince().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatalf("expected the listener to stay up: %s", err)
+	}
+	t0 := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the waiting connection to close, got %v", err)
+	}
+	if d := time.Since(t0); d < 200*time.Millisecond {
+		t.Fatalf("expected the connection to wait, closed after %s", d)
+	}
+	conn.Close()
+	//the same listener serves once reconnected
+	proxy.block(false)
+	for i := 0; i < 300 && c.ConnectedSince().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketPing(t *testing.T) {
+	testStalledLink(t, &chclient.Config{WebSocketPing: 200 * time.Millisecond})
+}
+
+func TestKeepAliveReconnect(t *testing.T) {
+	testStalledLink(t, &chclient.Config{KeepAlive: 200 * time.Millisecond})
+}
+
+//testStalledLink checks the client detects a
+//silently dead link, and then reconnects
+func testStalledLink(t *testing.T, config *chclient.Config) {
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+	config.Proxy = "http://" + proxy.Addr().String()
+	config.Remotes = []string{availablePort() + ":$FILEPORT"}
+	config.MaxRetryCount = -1
+	tl := testLayout{
+		server:     &chserver.Config{},
+		client:     config,
+		fileServer: true,
+	}
+	_, c, teardown := tl.setup(t)
+	defer teardown()
+	//the link dies silently, without keepalives
+	proxy.stall(true)
+	for i := 0; i < 200 && !c.ConnectedSince().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.ConnectedSince().IsZero() {
+		t.Fatal("expected the dead link to disconnect")
+	}
+	proxy.sever()
+	proxy.stall(false)
+	for i := 0; i < 300 && c.ConnectedSince().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.ConnectedSince().IsZero() {
+		t.Fatal("expected to reconnect")
+	}
+}
+
+func TestIdleDisconnect(t *testing.T) {
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{
+			Remotes:        []string{tmpPort + ":$FILEPORT"},
+			IdleDisconnect: 200 * time.Millisecond,
+		},
+		fileServer: true,
+	}
+	server, c, teardown := tl.setup(t)
+	defer teardown()
+	//new connection per request
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	send := func() {
+		resp, err := client.Post("http://127.0.0.1:"+tmpPort, "text/plain", strings.NewReader("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	//activity keeps the connection
+	for i := 0; i < 5; i++ {
+		send()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if c.Idle() || len(server.Sessions()) != 1 {
+		t.Fatal("expected to stay connected while active")
+	}
+	for i := 0; i < 100 && (!c.Idle() || len(server.Sessions()) != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.Idle() || len(server.Sessions()) != 0 {
+		t.Fatal("expected to disconnect while idle")
+	}
+	//reconnects on demand
+	send()
+	if c.Idle() || len(server.Sessions()) != 1 {
+		t.Fatal("expected to reconnect on demand")
+	}
+}
+
+func TestFallbackDirect(t *testing.T) {
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+	tmpPort := availablePort()
+	var mut sync.Mutex
+	direct := []string{}
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{
+			Proxy:            "http://" + proxy.Addr().String(),
+			Remotes:          []string{"fallback-direct=true:" + tmpPort + ":$FILEPORT"},
+			ReconnectWait:    100 * time.Millisecond,
+			MaxRetryCount:    -1,
+			MaxRetryInterval: time.Second,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr != proxy.Addr().String() {
+					mut.Lock()
+					direct = append(direct, addr)
+					mut.Unlock()
+				}
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+		fileServer: true,
+	}
+	_, c, teardown := tl.setup(t)
+	defer teardown()
+	send := func() (string, error) {
+		client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Post("http://127.0.0.1:"+tmpPort, "text/plain", strings.NewReader("foo"))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	if _, err := send(); err != nil {
+		t.Fatal(err)
+	}
+	mut.Lock()
+	if len(direct) != 0 {
+		t.Fatalf("expected the tunnel to be used while connected, dialed %v", direct)
+	}
+	mut.Unlock()
+	//lose the server, connections are dialed directly
+	proxy.block(true)
+	proxy.sever()
+	for i := 0; i < 100 && !c.ConnectedSince().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, err := send(); err != nil || b != "foo!" {
+		t.Fatalf("expected a direct connection, got %q (%v)", b, err)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if len(direct) != 1 {
+		t.Fatalf("expected one direct dial, got %v", direct)
+	}
+}
+
+func TestServerWebSocketPing(t *testing.T) {
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+	tl := testLayout{
+		server: &chserver.Config{
+			WebSocketPing: 100 * time.Millisecond,
+		},
+		client: &chclient.Config{
+			Proxy:   "http://" + proxy.Addr().String(),
+			Remotes: []string{availablePort() + ":$FILEPORT"},
+		},
+		fileServer: true,
+	}
+	s, _, teardown := tl.setup(t)
+	defer teardown()
+	//answered pings keep the client connected
+	time.Sleep(300 * time.Millisecond)
+	if len(s.Sessions()) != 1 {
+		t.Fatal("expected the client to stay connected")
+	}
+	//the link dies silently, the server notices
+	proxy.stall(true)
+	defer proxy.stall(false)
+	for i := 0; i < 200 && len(s.Sessions()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.Sessions()) > 0 {
+		t.Fatal("expected the server to drop the dead link")
+	}
+}
@@ -0,0 +1,101 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestRedirect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, err := chserver.NewServer(&chserver.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePort := availablePort()
+	if err := node.StartContext(ctx, "127.0.0.1", nodePort); err != nil {
+		t.Fatal(err)
+	}
+	front, err := chserver.NewServer(&chserver.Config{
+		Redirect: func(user string, addr net.Addr) string {
+			return "http://127.0.0.1:" + nodePort
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontPort := availablePort()
+	if err := front.StartContext(ctx, "127.0.0.1", frontPort); err != nil {
+		t.Fatal(err)
+	}
+	//the servers' keys differ, so the client is unpinned
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:  "http://127.0.0.1:" + frontPort,
+		Remotes: []string{availablePort()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(node.Sessions()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(node.Sessions()) != 1 {
+		t.Fatal("expected the client to connect to the node")
+	}
+	if s := client.Config().Server; s != "ws://127.0.0.1:"+nodePort {
+		t.Fatalf("expected the node to be the effective server, got %s", s)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//the server redirects to itself
+	port := availablePort()
+	redirects := int32(0)
+	server, err := chserver.NewServer(&chserver.Config{
+		Redirect: func(user string, addr net.Addr) string {
+			atomic.AddInt32(&redirects, 1)
+			return "http://127.0.0.1:" + port
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:      "http://127.0.0.1:" + port,
+		Fingerprint: server.GetFingerprint(),
+		Remotes:     []string{availablePort()},
+		RetryPolicy: chclient.RetryNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//the first redirect, then 5 more are
+	//followed, before giving up
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to stop following redirects")
+	}
+	if n := atomic.LoadInt32(&redirects); n != 6 {
+		t.Fatalf("expected 6 redirects before giving up, got %d", n)
+	}
+}
@@ -0,0 +1,408 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+func TestDisableRemote(t *testing.T) {
+	tmpPort := availablePort()
+	spec := tmpPort + ":$FILEPORT"
+	tl := testLayout{
+		server:     &chserver.Config{},
+		client:     &chclient.Config{Remotes: []string{spec}},
+		fileServer: true,
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	//fileport was substituted during setup
+	spec = tl.client.Remotes[0]
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DisableRemote(spec); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", "localhost:"+tmpPort); err == nil {
+		conn.Close()
+		t.Fatal("expected disabled remote to refuse connections")
+	}
+	if s := client.Tunnels()[0].State; s != chclient.TunnelDisabled {
+		t.Fatalf("expected disabled state, got %s", s)
+	}
+	if err := client.EnableRemote(spec); err != nil {
+		t.Fatal(err)
+	}
+	result, err := post("http://localhost:"+tmpPort, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "bar!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestDrainRemote(t *testing.T) {
+	tmpPort := availablePort()
+	tl := testLayout{
+		server:     &chserver.Config{},
+		client:     &chclient.Config{Remotes: []string{tmpPort + ":$FILEPORT"}},
+		fileServer: true,
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	spec := tl.client.Remotes[0]
+	//an open connection outlives the drain
+	open, err := net.Dial("tcp", "localhost:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Drain(spec); err != nil {
+		t.Fatal(err)
+	}
+	if s := client.Tunnels()[0].State; s != chclient.TunnelDraining {
+		t.Fatalf("expected draining state, got %s", s)
+	}
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected drained remote to refuse new connections")
+	}
+	open.Write([]byte("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nfoo"))
+	open.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 512)
+	if n, err := open.Read(b); err != nil || !strings.HasSuffix(string(b[:n]), "foo!") {
+		t.Fatalf("expected the open connection to work, got %q (%v)", b[:n], err)
+	}
+	if err := client.Undrain(spec); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := post("http://localhost:"+tmpPort, "bar"); err != nil || result != "bar!" {
+		t.Fatalf("expected bar!, got %q (%v)", result, err)
+	}
+}
+
+func TestServerPushRemotes(t *testing.T) {
+	initialPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true},
+		client: &chclient.Config{
+			Remotes:            []string{initialPort + ":$FILEPORT"},
+			AllowServerRemotes: true,
+		},
+		fileServer: true,
+	}
+	server, _, teardown := tl.setup(t)
+	defer teardown()
+	//fileport was substituted during setup
+	_, filePort, _ := net.SplitHostPort(tl.client.Remotes[0])
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	sid := sessions[0]
+	for _, prefix := range []string{"", "R:"} {
+		port := availablePort()
+		spec := prefix + port + ":" + filePort
+		if err := server.AddClientRemote(sid, spec); err != nil {
+			t.Fatal(err)
+		}
+		result, err := post("http://localhost:"+port, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+		if err := server.RemoveClientRemote(sid, spec); err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := net.Dial("tcp", "localhost:"+port); err == nil {
+			conn.Close()
+			t.Fatalf("expected removed remote %s to refuse connections", spec)
+		}
+	}
+}
+
+func TestServerPushRemotesDenied(t *testing.T) {
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{},
+	}
+	server, _, teardown := tl.setup(t)
+	defer teardown()
+	sid := server.Sessions()[0]
+	if err := server.AddClientRemote(sid, availablePort()); err == nil {
+		t.Fatal("expected client to reject server remote")
+	}
+	//rejection must not disconnect the client
+	if len(server.Sessions()) != 1 {
+		t.Fatal("expected client to remain connected")
+	}
+}
+
+func TestReverseBindRetry(t *testing.T) {
+	//with and without bind retries, the
+	//client keeps retrying until it binds
+	for _, retries := range []int{0, 10} {
+		//occupy the server side port
+		port := availablePort()
+		l, err := net.Listen("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl := testLayout{
+			server: &chserver.Config{Reverse: true},
+			client: &chclient.Config{
+				Remotes:            []string{"R:127.0.0.1:" + port + ":$FILEPORT"},
+				ReverseBindRetries: retries,
+				MaxRetryCount:      -1,
+			},
+			fileServer: true,
+		}
+		server, _, teardown := tl.setup(t)
+		if n := len(server.Sessions()); n != 0 {
+			t.Fatalf("expected the bind to fail, got %d sessions", n)
+		}
+		//free the port, the client should retry and bind it
+		l.Close()
+		for i := 0; i < 300 && len(server.Sessions()) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		result, err := post("http://127.0.0.1:"+port, "foo")
+		teardown()
+		if err != nil {
+			t.Fatalf("retries %d: %s", retries, err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
+
+func TestMultipleLocalHosts(t *testing.T) {
+	port := availablePort()
+	tl := testLayout{
+		server:     &chserver.Config{},
+		client:     &chclient.Config{Remotes: []string{"127.0.0.1,127.0.0.2:" + port + ":127.0.0.1:$FILEPORT"}},
+		fileServer: true,
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		if result, err := post("http://"+host+":"+port, "foo"); err != nil || result != "foo!" {
+			t.Fatalf("%s: expected foo!, got %q (%v)", host, result, err)
+		}
+	}
+	if l := client.Tunnels()[0].Listeners; len(l) != 2 || l[1] != "127.0.0.2:"+port {
+		t.Fatalf("expected both listeners, got %v", l)
+	}
+}
+
+func TestMultipleLocalHostsRollback(t *testing.T) {
+	port := availablePort()
+	//the second host is taken
+	taken, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:     "http://127.0.0.1:1",
+		Remotes:    []string{"127.0.0.1,127.0.0.2:" + port + ":127.0.0.1:3000"},
+		SyncListen: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Start(context.Background()); err == nil {
+		t.Fatal("expected the bind to fail")
+	}
+	//the first host was released
+	l, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("expected the first listener to be closed: %s", err)
+	}
+	l.Close()
+}
+
+func TestReverseAlternatePort(t *testing.T) {
+	port := availablePort()
+	//another client's port
+	taken, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	bound := make(chan string, 1)
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true},
+		client: &chclient.Config{
+			Remotes:              []string{"R:127.0.0.1:" + port + ":127.0.0.1:$FILEPORT"},
+			RequestAlternatePort: true,
+			OnRemoteBound:        func(r settings.Remote, addr string) { bound <- addr },
+		},
+		fileServer: true,
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	var l []string
+	for i := 0; i < 100; i++ {
+		if l = client.Tunnels()[0].Listeners; l[0] != "127.0.0.1:"+port {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l[0] == "127.0.0.1:"+port {
+		t.Fatalf("expected an alternate port, got %v", l)
+	}
+	if result, err := post("http://"+l[0], "foo"); err != nil || result != "foo!" {
+		t.Fatalf("expected foo! via %s, got %q (%v)", l[0], result, err)
+	}
+	//embedders learn the alternate port
+	select {
+	case addr := <-bound:
+		if addr != l[0] {
+			t.Fatalf("expected OnRemoteBound with %s, got %s", l[0], addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected OnRemoteBound")
+	}
+}
+
+func TestRemotePool(t *testing.T) {
+	//both hosts of the pool reach this endpoint
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	refuse := int32(0)
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true},
+		client: &chclient.Config{
+			Remotes: []string{"R:" + tmpPort + ":127.0.0.1*3,localhost:" + endPort},
+			DialFilter: func(ctx context.Context, r settings.Remote, network, addr string) (string, error) {
+				if atomic.LoadInt32(&refuse) == 1 && strings.HasPrefix(addr, "127.0.0.1:") {
+					return "", errors.New("refused")
+				}
+				return addr, nil
+			},
+		},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	connect := func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if string(b) != "ok" {
+			t.Fatalf("expected ok, got %q", b)
+		}
+	}
+	targets := func() map[string]int64 {
+		for _, s := range client.Stats().Remotes {
+			if s.Targets != nil {
+				return s.Targets
+			}
+		}
+		return nil
+	}
+	//weighted round-robin
+	for i := 0; i < 4; i++ {
+		connect()
+	}
+	a, b := "127.0.0.1:"+endPort, "localhost:"+endPort
+	if ts := targets(); ts[a] != 3 || ts[b] != 1 {
+		t.Fatalf("expected 3 and 1 connections, got %v", ts)
+	}
+	//fails over to the next target
+	atomic.StoreInt32(&refuse, 1)
+	for i := 0; i < 4; i++ {
+		connect()
+	}
+	if ts := targets(); ts[a] != 3 || ts[b] != 5 {
+		t.Fatalf("expected 3 and 5 connections, got %v", ts)
+	}
+}
+
+func TestRemoteLimits(t *testing.T) {
+	if _, err := chclient.NewClient(&chclient.Config{
+		Server:     "localhost:1",
+		Remotes:    []string{availablePort(), availablePort()},
+		MaxRemotes: 1,
+	}); err == nil || !strings.Contains(err.Error(), "Too many remotes") {
+		t.Fatalf("expected too many remotes, got %v", err)
+	}
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true, MaxReverseRemotes: 1},
+		client: &chclient.Config{
+			Remotes:            []string{availablePort() + ":$FILEPORT"},
+			AllowServerRemotes: true,
+			MaxRemotes:         2,
+		},
+		fileServer: true,
+	}
+	server, client, teardown := tl.setup(t)
+	defer teardown()
+	if e := client.Config(); e.MaxRemotes != 2 || e.MaxReverseRemotes != 0 {
+		t.Fatalf("expected the limits in the effective config, got %+v", e)
+	}
+	_, filePort, _ := net.SplitHostPort(tl.client.Remotes[0])
+	sid := server.Sessions()[0]
+	if err := server.AddClientRemote(sid, "R:"+availablePort()+":"+filePort); err != nil {
+		t.Fatal(err)
+	}
+	//the server's limit
+	if err := server.AddClientRemote(sid, "R:"+availablePort()+":"+filePort); err == nil || !strings.Contains(err.Error(), "Too many reverse remotes") {
+		t.Fatalf("expected too many reverse remotes, got %v", err)
+	}
+	//the client's limit
+	if err := client.AddRemote(availablePort() + ":" + filePort); err == nil || !strings.Contains(err.Error(), "Too many remotes") {
+		t.Fatalf("expected too many remotes, got %v", err)
+	}
+	//clients requesting too many are refused
+	other, err := chclient.NewClient(&chclient.Config{
+		Server:        tl.client.Server,
+		Fingerprint:   tl.client.Fingerprint,
+		Remotes:       []string{"R:" + availablePort() + ":" + filePort, "R:" + availablePort() + ":" + filePort},
+		LogBufferSize: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Debug = true
+	if err := other.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	other.Wait()
+	if logs := strings.Join(other.RecentLogs(20), "\n"); !strings.Contains(logs, "Too many reverse remotes") {
+		t.Fatalf("expected the server to refuse, got %q", logs)
+	}
+}
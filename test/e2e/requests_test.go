@@ -0,0 +1,79 @@
+package e2e_test
+
+import (
+	"os"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestRequestHandlers(t *testing.T) {
+	tl := testLayout{
+		server: &chserver.Config{
+			RequestHandlers: map[string]func([]byte) (bool, []byte){
+				"x-hello": func(p []byte) (bool, []byte) {
+					return true, append([]byte("hello "), p...)
+				},
+			},
+		},
+		client: &chclient.Config{
+			RequestHandlers: map[string]func([]byte) (bool, []byte){
+				"x-status": func([]byte) (bool, []byte) {
+					return true, []byte("ok")
+				},
+			},
+		},
+	}
+	server, client, teardown := tl.setup(t)
+	defer teardown()
+	//client to server
+	ok, reply, err := client.SendRequest("x-hello", []byte("client"))
+	if err != nil || !ok || string(reply) != "hello client" {
+		t.Fatalf("unexpected reply %v %q %v", ok, reply, err)
+	}
+	//unknown types are rejected
+	if ok, _, err := client.SendRequest("x-unknown", nil); err != nil || ok {
+		t.Fatalf("expected rejection, got %v %v", ok, err)
+	}
+	//server to client
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	ok, reply, err = server.SendRequest(sessions[0], "x-status", nil)
+	if err != nil || !ok || string(reply) != "ok" {
+		t.Fatalf("unexpected reply %v %q %v", ok, reply, err)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	hostname, _ := os.Hostname()
+	for _, test := range []struct {
+		client   chclient.Config
+		expected string
+	}{
+		{chclient.Config{ClientID: "worker-7"}, "worker-7"},
+		{chclient.Config{}, hostname},
+		{chclient.Config{ClientID: "worker-7", NoClientID: true}, ""},
+	} {
+		//a copy per client, which may outlive the iteration
+		cfg := test.client
+		tl := testLayout{server: &chserver.Config{}, client: &cfg}
+		server, client, teardown := tl.setup(t)
+		stop := func() {
+			teardown()
+			client.Wait()
+		}
+		sessions := server.Sessions()
+		if len(sessions) != 1 {
+			stop()
+			t.Fatalf("expected 1 session, got %d", len(sessions))
+		}
+		id, err := server.ClientID(sessions[0])
+		stop()
+		if err != nil || id != test.expected {
+			t.Fatalf("expected client ID %q, got %q (%v)", test.expected, id, err)
+		}
+	}
+}
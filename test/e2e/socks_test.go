@@ -1,5 +1,94 @@
 package e2e_test
 
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
 //TODO tests for:
-// - SOCKS-client -> [client -> server SOCKS] -> endpoint
 // - SOCKS-client -> [server -> client SOCKS] -> endpoint
+
+func TestSocksVersions(t *testing.T) {
+	//endpoint echoes
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	endPort, _ := strconv.Atoi(p)
+	port := []byte{byte(endPort >> 8), byte(endPort)}
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{Remotes: []string{"127.0.0.1:" + socksPort + ":socks"}})
+	defer teardown()
+	for _, test := range []struct {
+		name      string
+		handshake [][]byte //request, expected reply
+		ok        bool
+	}{
+		{"socks4", [][]byte{
+			append(append([]byte{4, 1}, port...), 127, 0, 0, 1, 'u', 0),
+			{0, 90, 0, 0, 0, 0, 0, 0},
+		}, true},
+		{"socks4a", [][]byte{
+			append(append([]byte{4, 1}, port...), append([]byte{0, 0, 0, 1, 0}, "localhost\x00"...)...),
+			{0, 90, 0, 0, 0, 0, 0, 0},
+		}, true},
+		{"socks4 bind", [][]byte{
+			append(append([]byte{4, 2}, port...), 127, 0, 0, 1, 0),
+			{0, 91, 0, 0, 0, 0, 0, 0},
+		}, false},
+		{"socks5", [][]byte{
+			{5, 1, 0}, {5, 0},
+			append([]byte{5, 1, 0, 1, 127, 0, 0, 1}, port...), {5, 0, 0, 1},
+		}, true},
+		{"malformed", [][]byte{{9, 9, 9}}, false},
+	} {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+socksPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(test.handshake); i += 2 {
+			conn.Write(test.handshake[i])
+			if i+1 == len(test.handshake) {
+				break
+			}
+			expected := test.handshake[i+1]
+			reply := make([]byte, len(expected))
+			if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, expected) {
+				t.Fatalf("%s: expected reply %v, got %v (%v)", test.name, expected, reply, err)
+			}
+		}
+		if test.name == "socks5" {
+			//skip the rest of the bound address
+			io.ReadFull(conn, make([]byte, 6))
+		}
+		conn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		if test.ok && (err != nil || string(b) != "ping") {
+			t.Fatalf("%s: expected echo, got %q (%v)", test.name, b, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%s: expected the connection to close", test.name)
+		}
+		conn.Close()
+	}
+}
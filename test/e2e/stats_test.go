@@ -0,0 +1,300 @@
+package e2e_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+func TestStatsOnReset(t *testing.T) {
+	const size = 100 * 1000
+	//endpoint reports once it has read size bytes
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	arrived := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, size))
+		close(arrived)
+		io.Copy(ioutil.Discard, c)
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{Remotes: []string{tmpPort + ":127.0.0.1:" + endPort}},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	sent := func() int64 {
+		return client.Stats().Remotes[tmpPort+"=>"+endPort].Sent
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+	//counted while the connection is still open
+	if n := sent(); n != size {
+		t.Fatalf("expected %d bytes sent mid-transfer, got %d", size, n)
+	}
+	//then reset it, and the count is unchanged
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := sent(); n != size {
+		t.Fatalf("expected %d bytes sent after reset, got %d", size, n)
+	}
+}
+
+func TestConnRate(t *testing.T) {
+	//endpoint holds connections open
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{Remotes: []string{"conn-rate=10:" + tmpPort + ":127.0.0.1:" + endPort}},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	//a burst of 10, then 10 more queued within a
+	//second, leaving the rest to be rejected
+	for i := 0; i < 25; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	s := client.Stats().Admission
+	if s.Throttled == 0 || s.Rejected == 0 {
+		t.Fatalf("expected throttled and rejected connections, got %+v", s)
+	}
+	if s.Throttled+s.Rejected > 15 {
+		t.Fatalf("expected the first 10 connections to pass, got %+v", s)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	//endpoint holds connections open, until the tunnel closes them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{Remotes: []string{"max-lifetime=200ms:" + tmpPort + ":127.0.0.1:" + endPort}},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//both ends are closed, despite the activity
+	conn.Write([]byte("active"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the local end to be closed, got %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the endpoint to be closed")
+	}
+	if n := client.Stats().Expired; n != 1 {
+		t.Fatalf("expected 1 expired connection, got %d", n)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	//endpoint holds connections open
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	_, endPort, _ := net.SplitHostPort(l.Addr().String())
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{Remotes: []string{tmpPort + ":127.0.0.1:" + endPort}},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && (len(client.Connections()) != 1 || client.Connections()[0].Sent != 5); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := client.Connections()
+	if len(conns) != 1 || conns[0].Sent != 5 || conns[0].LocalAddr != "127.0.0.1:"+tmpPort || conns[0].RemoteAddr != conn.LocalAddr().String() {
+		t.Fatalf("expected the open connection, got %+v", conns)
+	}
+	if err := client.CloseConnection(conns[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	//closed immediately
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+	if n := len(client.Connections()); n != 0 || client.Stats().Closed != 1 {
+		t.Fatalf("expected no connections and 1 closed, got %d and %d", n, client.Stats().Closed)
+	}
+	if err := client.CloseConnection(conns[0].ID); err == nil {
+		t.Fatal("expected an unknown connection error")
+	}
+}
+
+func TestStatsLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels   chclient.Config
+		expected []string
+	}{
+		{chclient.Config{}, []string{"$A=>$FILEPORT", "$B=>$FILEPORT"}},
+		{chclient.Config{StatsLabels: tunnel.LabelByName}, []string{"web", tunnel.UnnamedRemotes}},
+		{chclient.Config{StatsLabels: tunnel.LabelNone}, nil},
+	} {
+		a, b := availablePort(), availablePort()
+		config := test.labels
+		config.Remotes = []string{"name=web:" + a + ":$FILEPORT", b + ":$FILEPORT"}
+		tl := testLayout{
+			server:     &chserver.Config{},
+			client:     &config,
+			fileServer: true,
+		}
+		_, client, teardown := tl.setup(t)
+		fileport := strings.Split(config.Remotes[0], ":")[2]
+		for _, port := range []string{a, b} {
+			if result, err := post("http://127.0.0.1:"+port, "foo"); err != nil || result != "foo!" {
+				t.Fatalf("expected foo!, got %q (%v)", result, err)
+			}
+		}
+		stats := client.Stats()
+		teardown()
+		if len(stats.Remotes) != len(test.expected) {
+			t.Fatalf("expected %v, got %v", test.expected, stats.Remotes)
+		}
+		for _, k := range test.expected {
+			k = strings.NewReplacer("$A", a, "$B", b, "$FILEPORT", fileport).Replace(k)
+			if stats.Remotes[k].Sent == 0 {
+				t.Fatalf("expected traffic of %s, got %v", k, stats.Remotes)
+			}
+		}
+		if stats.Sent == 0 {
+			t.Fatal("expected total traffic")
+		}
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	endPort := availablePort()
+	tmpPort := availablePort()
+	tl := testLayout{
+		server: &chserver.Config{Reverse: true},
+		client: &chclient.Config{Remotes: []string{"R:dial-retries=10:dial-backoff=50ms:" + tmpPort + ":127.0.0.1:" + endPort}},
+	}
+	_, client, teardown := tl.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//the endpoint comes up while the dial is retried
+	time.Sleep(200 * time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:"+endPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("expected an echo once the endpoint is up, got %q (%v)", b, err)
+	}
+	s := client.Stats()
+	if s.DialRetries == 0 {
+		t.Fatal("expected the dial to be retried")
+	}
+	for k, rs := range s.Remotes {
+		if rs.DialRetries != s.DialRetries {
+			t.Fatalf("expected the retries counted on %s, got %d of %d", k, rs.DialRetries, s.DialRetries)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestRemoteTLS(t *testing.T) {
+	//tls endpoint, its certificate doubles as our ca and local cert
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure!"))
+	}))
+	defer backend.Close()
+	dir, err := ioutil.TempDir("", "chisel-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := backend.TLS.Certificates[0]
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	backendPort := backend.URL[strings.LastIndex(backend.URL, ":")+1:]
+	originPort := availablePort()
+	terminatePort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{TLSRemoteDir: dir},
+		&chclient.Config{
+			Remotes: []string{
+				//the server reads its ca from its dir
+				"tls-ca=cert.pem:" + originPort + ":127.0.0.1:" + backendPort,
+				"tls-cert=" + certFile + ":tls-key=" + keyFile + ":" + terminatePort + ":$FILEPORT",
+			},
+		})
+	defer teardown()
+	//plaintext in, tls out
+	result, err := post("http://127.0.0.1:"+originPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "secure!" {
+		t.Fatalf("expected 'secure!' but got '%s'", result)
+	}
+	//tls in, plaintext out
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	c := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	resp, err := c.Post("https://127.0.0.1:"+terminatePort, "text/plain", strings.NewReader("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "foo!" {
+		t.Fatalf("expected 'foo!' but got '%s'", b)
+	}
+}
+
+func TestRemoteTLSInvalidCert(t *testing.T) {
+	_, err := chclient.NewClient(&chclient.Config{
+		Server:  "localhost:1",
+		Remotes: []string{"R:tls-ca=/does/not/exist.pem:3000:example.com:443"},
+	})
+	if err == nil {
+		t.Fatal("expected error for missing tls-ca")
+	}
+}
+
+func TestRemoteTLSServerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chisel-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		dir, remote string
+	}{
+		//tls files are disabled
+		{"", "tls-ca=cert.pem:3000:example.com:443"},
+		//paths must stay within the dir
+		{dir, "tls-ca=/etc/hosts:3000:example.com:443"},
+		{dir, "tls-ca=../cert.pem:3000:example.com:443"},
+		{dir, "R:tls-cert=/etc/cert.pem:tls-key=/etc/key.pem:3000:example.com:80"},
+	} {
+		server, err := chserver.NewServer(&chserver.Config{
+			Reverse:      true,
+			TLSRemoteDir: test.dir,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := availablePort()
+		if err := server.StartContext(context.Background(), "127.0.0.1", port); err != nil {
+			t.Fatal(err)
+		}
+		client, err := chclient.NewClient(&chclient.Config{
+			Server:        "http://127.0.0.1:" + port,
+			Fingerprint:   server.GetFingerprint(),
+			Remotes:       []string{test.remote},
+			LogBufferSize: 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Debug = true
+		if err := client.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		client.Wait()
+		server.Close()
+		//the server doesn't say why
+		logs := strings.Join(client.RecentLogs(10), "\n")
+		if !strings.Contains(logs, "invalid tls options") || strings.Contains(logs, "no such file") {
+			t.Fatalf("%s: expected the remote to be refused, got %s", test.remote, logs)
+		}
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
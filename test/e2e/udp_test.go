@@ -86,3 +86,91 @@ func availableUDPPort() string {
 	}
 	return port
 }
+
+func TestTCPUDP(t *testing.T) {
+	//a tcp and a udp echo server on the same port
+	tl, ul := listenTCPUDP(t)
+	defer tl.Close()
+	defer ul.Close()
+	_, echoPort, _ := net.SplitHostPort(tl.Addr().String())
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 128)
+				n, _ := c.Read(b)
+				c.Write(append(b[:n], '!'))
+			}()
+		}
+	}()
+	go func() {
+		b := make([]byte, 128)
+		for {
+			n, a, err := ul.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			ul.WriteTo(append(b[:n], b[:n]...), a)
+		}
+	}()
+	//forward both with one remote
+	l, u := listenTCPUDP(t)
+	l.Close()
+	u.Close()
+	_, inboundPort, _ := net.SplitHostPort(l.Addr().String())
+	tlc := testLayout{
+		server: &chserver.Config{},
+		client: &chclient.Config{
+			Remotes: []string{inboundPort + ":" + echoPort + "/tcp+udp"},
+		},
+	}
+	_, c, teardown := tlc.setup(t)
+	defer teardown()
+	if ts := c.Tunnels(); len(ts) != 1 || ts[0].Remote != inboundPort+"=>"+echoPort+"/tcp+udp" {
+		t.Fatalf("expected a single tunnel, got %v", ts)
+	}
+	echo := func(network, msg string) string {
+		conn, err := net.Dial(network, "127.0.0.1:"+inboundPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 128)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+	if s := echo("tcp4", "foo"); s != "foo!" {
+		t.Fatalf("expected tcp echo, got %q", s)
+	}
+	if s := echo("udp4", "bazz"); s != "bazzbazz" {
+		t.Fatalf("expected udp echo, got %q", s)
+	}
+}
+
+//listenTCPUDP binds a tcp and a udp socket on the same free port
+func listenTCPUDP(t *testing.T) (net.Listener, net.PacketConn) {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := net.ListenPacket("udp4", l.Addr().String())
+		if err == nil {
+			return l, u
+		}
+		l.Close()
+	}
+	t.Fatal("no free tcp+udp port")
+	return nil, nil
+}